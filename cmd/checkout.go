@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/fioncat/grfs/daemon"
+	"github.com/fioncat/grfs/storage"
+	"github.com/fioncat/grfs/types"
+	"github.com/spf13/cobra"
+)
+
+func Checkout() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "checkout URL|PATH REF",
+		Short: "Switch the ref of a mounted repository without remounting",
+
+		Args: cobra.ExactArgs(2),
+
+		RunE: func(_ *cobra.Command, args []string) error {
+			cfg, err := types.LoadConfig()
+			if err != nil {
+				return fmt.Errorf("load config: %w", err)
+			}
+			metadata, err := storage.OpenBolt(cfg)
+			if err != nil {
+				return fmt.Errorf("open metadata database: %w", err)
+			}
+			defer metadata.Close()
+
+			mp, err := findMountPoint(metadata, args[0])
+			if err != nil {
+				return err
+			}
+			return checkoutMountPoint(cfg, metadata, mp, args[1])
+		},
+	}
+	cmd.ValidArgsFunction = completeMountpoint
+
+	return cmd
+}
+
+// findMountPoint finds the mountpoint by its path or repository url. The ref
+// in url can be omitted if the repository is mounted only once.
+func findMountPoint(metadata types.MountPointMetadata, target string) (*types.MountPoint, error) {
+	mps, err := metadata.List()
+	if err != nil {
+		return nil, fmt.Errorf("list mountpoints: %w", err)
+	}
+
+	path, err := filepath.Abs(target)
+	if err == nil {
+		for _, mp := range mps {
+			if mp.Path == path {
+				return mp, nil
+			}
+		}
+	}
+
+	repo, err := types.ParseRepository(target)
+	if err != nil {
+		return nil, fmt.Errorf("%q is neither a mounted path nor a valid url: %w", target, err)
+	}
+	var found []*types.MountPoint
+	for _, mp := range mps {
+		if mp.Repo.Domain != repo.Domain || mp.Repo.Owner != repo.Owner || mp.Repo.Name != repo.Name {
+			continue
+		}
+		if repo.Ref != "" && mp.Repo.Ref != repo.Ref {
+			continue
+		}
+		found = append(found, mp)
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("could not find mountpoint for %q", target)
+	case 1:
+		return found[0], nil
+	default:
+		return nil, fmt.Errorf("%q is mounted %d times, please specify the ref or path", target, len(found))
+	}
+}
+
+func checkoutMountPoint(cfg *types.Config, metadata types.MountPointMetadata, mp *types.MountPoint, ref string) error {
+	if mp.Repo.MultiRef {
+		return errors.New("checkout is not supported in multi-ref layout, please use the \"@branches\", \"@tags\" or \"@commits\" directories")
+	}
+	if status, _ := mp.GetStatus(); status != types.MountPointStatusMounted {
+		return fmt.Errorf("mountpoint %q is %s, please mount it first", mp.Repo.String(), status)
+	}
+
+	newRepo := *mp.Repo
+	newRepo.Ref = ref
+	if newRepo.String() != mp.Repo.String() {
+		_, err := metadata.Get(&newRepo)
+		if err == nil {
+			return fmt.Errorf("%q has already been mounted", newRepo.String())
+		}
+		if !errors.Is(err, storage.ErrMountPointNotFound) {
+			return fmt.Errorf("get mountpoint from metadata: %w", err)
+		}
+	}
+
+	// The running daemon switches the ref by the control socket.
+	client := daemon.NewClient(types.GetSocketPath(cfg.BaseDir, mp.Path), daemonRequestTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), daemonRequestTimeout)
+	defer cancel()
+	repo, err := client.Checkout(ctx, ref)
+	if err != nil {
+		return fmt.Errorf("checkout %q, please check fs log file %q: %w", ref, mp.LogPath, err)
+	}
+	newRepo.Commit = repo.Commit
+
+	oldName := mp.Repo.String()
+	err = moveMountPoint(metadata, mp, &newRepo)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Checked out %q to %q, commit %s\n", oldName, ref, formatCommit(mp.Repo))
+	return nil
+}
+
+// moveMountPoint replaces the repository of mp in metadata. The new record is
+// put before removing the old one, so that the mountpoint is never lost from
+// metadata.
+func moveMountPoint(metadata types.MountPointMetadata, mp *types.MountPoint, repo *types.Repository) error {
+	oldMp := *mp
+	mp.Repo = repo
+	err := metadata.Put(mp)
+	if err != nil {
+		return fmt.Errorf("put mountpoint to metadata: %w", err)
+	}
+	if oldMp.Repo.String() != repo.String() {
+		err = metadata.Remove(&oldMp)
+		if err != nil && !errors.Is(err, storage.ErrMountPointNotFound) {
+			return fmt.Errorf("remove mountpoint in metadata: %w", err)
+		}
+	}
+	return nil
+}
+
+// saveCheckout saves the repository checked out by the control file of the
+// daemon serving mountPath. The metadata is opened only during saving, since
+// the CLI needs it too.
+func saveCheckout(cfg *types.Config, mountPath string, repo *types.Repository) error {
+	metadata, err := storage.OpenBolt(cfg)
+	if err != nil {
+		return fmt.Errorf("open metadata database: %w", err)
+	}
+	defer metadata.Close()
+
+	mp, err := findMountPoint(metadata, mountPath)
+	if err != nil {
+		return err
+	}
+	return moveMountPoint(metadata, mp, repo)
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/fioncat/grfs/daemon"
+	"github.com/fioncat/grfs/storage"
+	"github.com/fioncat/grfs/types"
+	"github.com/spf13/cobra"
+)
+
+// daemonRequestTimeout is the timeout for control requests, refreshing might
+// resolve the ref from the provider.
+const daemonRequestTimeout = time.Second * 30
+
+func Ctl() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ctl",
+		Short: "Control the running fuse daemon through its socket",
+	}
+
+	cmd.AddCommand(buildCtlCommand("refresh URL|PATH", "Drop caches and resolve the ref again", 0,
+		func(ctx context.Context, client *daemon.Client, mp *types.MountPoint, _ []string) error {
+			repo, err := client.Refresh(ctx)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Refreshed %q, commit %s\n", repo.String(), formatCommit(repo))
+			return nil
+		}))
+
+	cmd.AddCommand(buildCtlCommand("log-level URL|PATH LEVEL", "Set the log level of daemon", 1,
+		func(ctx context.Context, client *daemon.Client, mp *types.MountPoint, args []string) error {
+			err := client.SetLogLevel(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Set log level of %q to %s\n", mp.Repo.String(), args[0])
+			return nil
+		}))
+
+	cmd.AddCommand(buildCtlCommand("shutdown URL|PATH", "Unmount and stop the daemon gracefully", 0,
+		func(ctx context.Context, client *daemon.Client, mp *types.MountPoint, _ []string) error {
+			err := client.Shutdown(ctx)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Requested %q to shutdown\n", mp.Repo.String())
+			return nil
+		}))
+
+	return cmd
+}
+
+func buildCtlCommand(use, short string, nargs int, action func(ctx context.Context, client *daemon.Client, mp *types.MountPoint, args []string) error) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   use,
+		Short: short,
+
+		Args: cobra.ExactArgs(nargs + 1),
+
+		RunE: func(_ *cobra.Command, args []string) error {
+			cfg, err := types.LoadConfig()
+			if err != nil {
+				return fmt.Errorf("load config: %w", err)
+			}
+			metadata, err := storage.OpenBolt(cfg)
+			if err != nil {
+				return fmt.Errorf("open metadata database: %w", err)
+			}
+			defer metadata.Close()
+
+			mp, err := findMountPoint(metadata, args[0])
+			if err != nil {
+				return err
+			}
+			if status, _ := mp.GetStatus(); status != types.MountPointStatusMounted {
+				return fmt.Errorf("mountpoint %q is %s", mp.Repo.String(), status)
+			}
+
+			client := daemon.NewClient(types.GetSocketPath(cfg.BaseDir, mp.Path), daemonRequestTimeout)
+			return action(context.Background(), client, mp, args[1:])
+		},
+	}
+	cmd.ValidArgsFunction = completeMountpoint
+	return cmd
+}
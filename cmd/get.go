@@ -1,9 +1,13 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"time"
 
+	"github.com/dustin/go-humanize"
+	"github.com/fioncat/grfs/daemon"
 	"github.com/fioncat/grfs/osutils"
 	"github.com/fioncat/grfs/types"
 	"github.com/spf13/cobra"
@@ -48,14 +52,32 @@ func runGet(showJson *bool) func(opts *MountPointOptions, args []string) error {
 		rows := make([][]string, len(items))
 		for i, item := range items {
 			status := item.Status.Color()
+			repo := item.Repo
+			pid, uptime, fetched, errs, rateLimit := "-", "-", "-", "-", "-"
+			if item.Daemon != nil {
+				repo = item.Daemon.Repo
+				pid = fmt.Sprint(item.Daemon.PID)
+				uptime = time.Since(time.Unix(item.Daemon.StartTime, 0)).Round(time.Second).String()
+				fetched = humanize.IBytes(uint64(item.Daemon.Stats.DownloadBytes))
+				errs = fmt.Sprint(item.Daemon.Stats.Errors)
+				if item.Daemon.Stats.RateLimit != nil {
+					rateLimit = item.Daemon.Stats.RateLimit.String()
+				}
+			}
 			rows[i] = []string{
-				item.Repo.String(),
+				repo.String(),
 				status,
+				formatCommit(repo),
+				pid,
+				uptime,
+				fetched,
+				errs,
+				rateLimit,
 				item.Path,
 			}
 		}
 
-		osutils.ShowTable([]string{"Repository", "Status", "Path"}, rows)
+		osutils.ShowTable([]string{"Repository", "Status", "Commit", "PID", "Uptime", "Fetched", "Errors", "RateLimit", "Path"}, rows)
 		return nil
 	}
 }
@@ -66,7 +88,7 @@ func getMountpointItems(opts *MountPointOptions) ([]*types.MountPointDisplay, er
 		if err != nil {
 			return nil, fmt.Errorf("get mountpoint from metadata: %w", err)
 		}
-		return []*types.MountPointDisplay{mp.Display()}, nil
+		return []*types.MountPointDisplay{displayMountPoint(opts.Config, mp)}, nil
 	}
 
 	items, err := opts.Metadata.List()
@@ -76,8 +98,42 @@ func getMountpointItems(opts *MountPointOptions) ([]*types.MountPointDisplay, er
 
 	displayItems := make([]*types.MountPointDisplay, len(items))
 	for i, item := range items {
-		displayItems[i] = item.Display()
+		displayItems[i] = displayMountPoint(opts.Config, item)
 	}
 
 	return displayItems, nil
 }
+
+// daemonStatusTimeout is the timeout for querying the live information of a
+// daemon, the hanging daemon should not block the command.
+const daemonStatusTimeout = time.Second
+
+func displayMountPoint(cfg *types.Config, mp *types.MountPoint) *types.MountPointDisplay {
+	display := mp.Display()
+	if display.Status != types.MountPointStatusMounted {
+		return display
+	}
+
+	client := daemon.NewClient(types.GetSocketPath(cfg.BaseDir, mp.Path), daemonStatusTimeout)
+	status, err := client.Status(context.Background())
+	if err != nil {
+		// The daemon might be started by an older version without socket.
+		return display
+	}
+	display.Daemon = status
+	return display
+}
+
+func formatCommit(repo *types.Repository) string {
+	if repo.MultiRef {
+		return "(multi-ref)"
+	}
+	commit := repo.Commit
+	if len(commit) > 12 {
+		commit = commit[:12]
+	}
+	if repo.Follow {
+		return fmt.Sprintf("%s (follow)", commit)
+	}
+	return commit
+}
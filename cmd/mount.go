@@ -11,18 +11,33 @@ import (
 )
 
 func Mount() *cobra.Command {
+	var follow, multiRef bool
 	cmd := &cobra.Command{
-		Use:   "mount [URL] [PATH]",
+		Use:   "mount [--follow] [--multi-ref] [URL] [PATH]",
 		Short: "Mount grfs to a path",
 
 		Args: cobra.MaximumNArgs(2),
 	}
 
-	buildMountPointCommand(cmd, runMount)
+	buildMountPointCommand(cmd, runMount(&follow, &multiRef))
+
+	cmd.Flags().BoolVarP(&follow, "follow", "", false, "Follow the latest commit of ref, rather than pinning to the current commit")
+	cmd.Flags().BoolVarP(&multiRef, "multi-ref", "", false, "Mount the branches, tags and commits under \"@branches\", \"@tags\" and \"@commits\"")
+
 	return cmd
 }
 
-func runMount(opts *MountPointOptions, args []string) error {
+func runMount(follow, multiRef *bool) func(opts *MountPointOptions, args []string) error {
+	return func(opts *MountPointOptions, args []string) error {
+		if opts.Repo != nil {
+			opts.Repo.Follow = *follow
+			opts.Repo.MultiRef = *multiRef
+		}
+		return mountRepo(opts, args)
+	}
+}
+
+func mountRepo(opts *MountPointOptions, args []string) error {
 	if opts.Repo == nil {
 		mps, err := opts.Metadata.List()
 		if err != nil {
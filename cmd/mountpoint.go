@@ -30,6 +30,15 @@ func (m *grfsMounter) Mount(mp *types.MountPoint) error {
 	if mp.Repo.Ref != "" {
 		args = append(args, "--ref", mp.Repo.Ref)
 	}
+	if mp.Repo.Commit != "" {
+		args = append(args, "--commit", mp.Repo.Commit)
+	}
+	if mp.Repo.Follow {
+		args = append(args, "--follow")
+	}
+	if mp.Repo.MultiRef {
+		args = append(args, "--multi-ref")
+	}
 	if m.debug {
 		args = append(args, "--debug")
 	}
@@ -1,13 +1,20 @@
 package cmd
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
 
+	"github.com/fioncat/grfs/daemon"
 	"github.com/fioncat/grfs/fs"
+	"github.com/fioncat/grfs/metrics"
 	"github.com/fioncat/grfs/provider"
+	"github.com/fioncat/grfs/storage"
 	"github.com/fioncat/grfs/types"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -27,12 +34,18 @@ func Start() *cobra.Command {
 			if path == "" {
 				return errors.New("Path could not be empty")
 			}
+			// The control socket is located by the absolute mount path.
+			var err error
+			path, err = filepath.Abs(path)
+			if err != nil {
+				return fmt.Errorf("convert path to abs: %w", err)
+			}
 
 			if debug {
 				logrus.SetLevel(logrus.DebugLevel)
 			}
 
-			err := repo.Validate()
+			err = repo.Validate()
 			if err != nil {
 				return err
 			}
@@ -46,14 +59,62 @@ func Start() *cobra.Command {
 			if err != nil {
 				return err
 			}
+			err = provider.Check(context.Background())
+			if err != nil {
+				return err
+			}
+			if repo.IsPinned() {
+				logrus.Infof("Pin repository %s to commit %s", repo.String(), repo.Commit)
+			} else {
+				logrus.Infof("Follow the latest commit of %s", repo.String())
+			}
+
+			cache, err := storage.OpenBlobCache(config)
+			if err != nil {
+				return err
+			}
 
-			node := fs.NewNode(provider)
-			fs, err := fs.Mount(node, path, config)
+			var root fusefs.InodeEmbedder
+			var ctl types.DaemonController
+			if repo.MultiRef {
+				logrus.Info("Use multi-ref layout, the refs are under \"@branches\", \"@tags\" and \"@commits\"")
+				node := fs.NewRefsNode(&repo, provider, cache, config)
+				root, ctl = node, node
+			} else {
+				node := fs.NewNode(&repo, provider, cache, config)
+				node.SetRepoSaver(func(repo *types.Repository) error {
+					return saveCheckout(config, path, repo)
+				})
+				root, ctl = node, node
+			}
+			fs, err := fs.Mount(root, path, config)
 			if err != nil {
 				return err
 			}
 			defer fs.Unmount()
 
+			var metricsAddr string
+			if config.Fs.MetricsAddr != "" {
+				metricsServer, err := metrics.Serve(config.Fs.MetricsAddr, map[string]string{
+					"repo":  fmt.Sprintf("%s:%s", repo.Domain, repo.Path()),
+					"mount": path,
+				})
+				if err == nil {
+					defer metricsServer.Close()
+					metricsAddr = metricsServer.Addr
+				} else {
+					// The address might be used by another daemon, the metrics
+					// should not stop mounting.
+					logrus.Warnf("Serve metrics error: %v, use port 0 in fs.metricsAddr to serve each daemon on its own port", err)
+				}
+			}
+
+			server, err := daemon.Listen(types.GetSocketPath(config.BaseDir, path), ctl, metricsAddr)
+			if err != nil {
+				return err
+			}
+			defer server.Close()
+
 			sigStop := make(chan os.Signal, 1)
 			signal.Notify(sigStop, os.Interrupt)
 
@@ -63,6 +124,9 @@ func Start() *cobra.Command {
 
 			case <-fs.UnmountChan():
 				logrus.Info("The grfs was unmountted by user, stop server")
+
+			case <-server.ShutdownChan():
+				logrus.Info("Shutdown requested, stop server")
 			}
 
 			return errors.New("Server stopped")
@@ -84,6 +148,9 @@ func Start() *cobra.Command {
 	cmd.MarkFlagRequired("name")
 
 	flags.StringVarP(&repo.Ref, "ref", "r", "", "The repo ref")
+	flags.StringVarP(&repo.Commit, "commit", "c", "", "The commit to pin, resolve from ref if empty")
+	flags.BoolVarP(&repo.Follow, "follow", "", false, "Follow the latest commit of ref")
+	flags.BoolVarP(&repo.MultiRef, "multi-ref", "", false, "Mount all the refs of the repository")
 
 	flags.BoolVarP(&debug, "debug", "", false, "Set log level to debug")
 
@@ -0,0 +1,104 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/fioncat/grfs/types"
+)
+
+// Client calls the control socket of a fuse daemon.
+type Client struct {
+	httpClient *http.Client
+}
+
+func NewClient(path string, timeout time.Duration) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		},
+	}
+	return &Client{
+		httpClient: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+		},
+	}
+}
+
+func (c *Client) Status(ctx context.Context) (*types.DaemonStatus, error) {
+	var status types.DaemonStatus
+	err := c.do(ctx, http.MethodGet, "/status", nil, &status)
+	return &status, err
+}
+
+func (c *Client) Stats(ctx context.Context) (*types.FilesystemStats, error) {
+	var stats types.FilesystemStats
+	err := c.do(ctx, http.MethodGet, "/stats", nil, &stats)
+	return &stats, err
+}
+
+func (c *Client) Refresh(ctx context.Context) (*types.Repository, error) {
+	var repo types.Repository
+	err := c.do(ctx, http.MethodPost, "/refresh", nil, &repo)
+	return &repo, err
+}
+
+func (c *Client) Checkout(ctx context.Context, ref string) (*types.Repository, error) {
+	var repo types.Repository
+	err := c.do(ctx, http.MethodPost, "/checkout", &checkoutRequest{Ref: ref}, &repo)
+	return &repo, err
+}
+
+func (c *Client) SetLogLevel(ctx context.Context, level string) error {
+	return c.do(ctx, http.MethodPost, "/loglevel", &logLevelRequest{Level: level}, nil)
+}
+
+func (c *Client) Shutdown(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/shutdown", nil, nil)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, result interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&reqBody).Encode(body)
+		if err != nil {
+			return fmt.Errorf("encode request: %w", err)
+		}
+	}
+
+	// The host is ignored since the connection is dialed to the socket.
+	req, err := http.NewRequestWithContext(ctx, method, "http://grfs"+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request control socket: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp errorResponse
+		err = json.NewDecoder(resp.Body).Decode(&errResp)
+		if err != nil || errResp.Error == "" {
+			return fmt.Errorf("control socket returns status %d", resp.StatusCode)
+		}
+		return errors.New(errResp.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(result)
+	if err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
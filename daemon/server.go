@@ -0,0 +1,195 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fioncat/grfs/osutils"
+	"github.com/fioncat/grfs/types"
+	"github.com/sirupsen/logrus"
+)
+
+// Server serves the control socket of a fuse daemon. The API is JSON over
+// HTTP on a unix domain socket.
+type Server struct {
+	path string
+
+	ctl types.DaemonController
+
+	startTime   time.Time
+	metricsAddr string
+
+	listener   net.Listener
+	httpServer *http.Server
+
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type logLevelRequest struct {
+	Level string `json:"level"`
+}
+
+type checkoutRequest struct {
+	Ref string `json:"ref"`
+}
+
+// Listen creates the control socket on path, any stale socket left by an
+// exited daemon is removed. The metricsAddr is reported in status, empty if
+// the daemon does not serve metrics.
+func Listen(path string, ctl types.DaemonController, metricsAddr string) (*Server, error) {
+	err := osutils.EnsureFilePathDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("ensure socket dir: %w", err)
+	}
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("remove stale socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("listen control socket: %w", err)
+	}
+
+	s := &Server{
+		path:        path,
+		ctl:         ctl,
+		startTime:   time.Now(),
+		metricsAddr: metricsAddr,
+		listener:    listener,
+		shutdown:    make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handle(http.MethodGet, s.status))
+	mux.HandleFunc("/stats", s.handle(http.MethodGet, s.stats))
+	mux.HandleFunc("/refresh", s.handle(http.MethodPost, s.refresh))
+	mux.HandleFunc("/checkout", s.handle(http.MethodPost, s.checkout))
+	mux.HandleFunc("/loglevel", s.handle(http.MethodPost, s.setLogLevel))
+	mux.HandleFunc("/shutdown", s.handle(http.MethodPost, s.requestShutdown))
+	s.httpServer = &http.Server{Handler: mux}
+
+	go func() {
+		logrus.Infof("Serve control socket %q", path)
+		err := s.httpServer.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Errorf("Serve control socket error: %v", err)
+		}
+	}()
+
+	return s, nil
+}
+
+// ShutdownChan is closed when a graceful shutdown is requested.
+func (s *Server) ShutdownChan() <-chan struct{} {
+	return s.shutdown
+}
+
+func (s *Server) Close() {
+	err := s.httpServer.Close()
+	if err != nil {
+		logrus.Warnf("Close control socket error: %v", err)
+	}
+	err = os.Remove(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("Remove control socket error: %v", err)
+	}
+}
+
+func (s *Server) handle(method string, fn func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeJSON(w, http.StatusMethodNotAllowed, &errorResponse{Error: "method not allowed"})
+			return
+		}
+
+		resp, err := fn(r)
+		if err != nil {
+			logrus.Errorf("Handle control request %q error: %v", r.URL.Path, err)
+			writeJSON(w, http.StatusInternalServerError, &errorResponse{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		logrus.Warnf("Write control response error: %v", err)
+	}
+}
+
+func (s *Server) status(_ *http.Request) (interface{}, error) {
+	return &types.DaemonStatus{
+		PID:       os.Getpid(),
+		StartTime: s.startTime.Unix(),
+		Repo:      s.ctl.Repository(),
+		Stats:     s.ctl.Stats(),
+		LogLevel:  logrus.GetLevel().String(),
+
+		MetricsAddr: s.metricsAddr,
+	}, nil
+}
+
+func (s *Server) stats(_ *http.Request) (interface{}, error) {
+	return s.ctl.Stats(), nil
+}
+
+func (s *Server) refresh(r *http.Request) (interface{}, error) {
+	err := s.ctl.Refresh(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	return s.ctl.Repository(), nil
+}
+
+func (s *Server) checkout(r *http.Request) (interface{}, error) {
+	var req checkoutRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return nil, fmt.Errorf("decode request: %w", err)
+	}
+	err = s.ctl.Checkout(r.Context(), req.Ref)
+	if err != nil {
+		return nil, err
+	}
+	return s.ctl.Repository(), nil
+}
+
+func (s *Server) setLogLevel(r *http.Request) (interface{}, error) {
+	var req logLevelRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return nil, fmt.Errorf("decode request: %w", err)
+	}
+	level, err := logrus.ParseLevel(req.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("Set log level to %s", level)
+	logrus.SetLevel(level)
+	return &logLevelRequest{Level: level.String()}, nil
+}
+
+func (s *Server) requestShutdown(_ *http.Request) (interface{}, error) {
+	logrus.Info("Received shutdown request from control socket")
+	s.shutdownOnce.Do(func() {
+		close(s.shutdown)
+	})
+	return struct{}{}, nil
+}
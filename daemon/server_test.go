@@ -0,0 +1,121 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fioncat/grfs/types"
+	"github.com/sirupsen/logrus"
+)
+
+type testController struct {
+	repo      *types.Repository
+	refreshes int
+	fail      bool
+}
+
+func (c *testController) Repository() *types.Repository {
+	repo := *c.repo
+	return &repo
+}
+
+func (c *testController) Stats() *types.FilesystemStats {
+	return &types.FilesystemStats{ReadFiles: 3, DownloadBytes: 1024}
+}
+
+func (c *testController) Refresh(ctx context.Context) error {
+	if c.fail {
+		return errors.New("resolve ref failed")
+	}
+	c.refreshes++
+	c.repo.Commit = "c2"
+	return nil
+}
+
+func (c *testController) Checkout(ctx context.Context, ref string) error {
+	if c.fail {
+		return errors.New("checkout failed")
+	}
+	c.repo.Ref, c.repo.Commit = ref, "c3"
+	return nil
+}
+
+func TestServer(t *testing.T) {
+	ctl := &testController{repo: &types.Repository{
+		Domain: "github.com",
+		Owner:  "fioncat",
+		Name:   "grfs",
+		Ref:    "main",
+		Commit: "c1",
+	}}
+	server, err := Listen("_test/grfs.sock", ctl, "127.0.0.1:9100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client := NewClient("_test/grfs.sock", time.Second)
+	ctx := context.Background()
+
+	status, err := client.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(status.Repo, ctl.repo) {
+		t.Fatalf("Unexpect status repo %+v", status.Repo)
+	}
+	if status.PID == 0 || status.Stats.DownloadBytes != 1024 || status.MetricsAddr != "127.0.0.1:9100" {
+		t.Fatalf("Unexpect status %+v", status)
+	}
+
+	repo, err := client.Refresh(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.Commit != "c2" || ctl.refreshes != 1 {
+		t.Fatalf("Unexpect repo after refresh %+v", repo)
+	}
+	repo, err = client.Checkout(ctx, "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.Ref != "dev" || repo.Commit != "c3" {
+		t.Fatalf("Unexpect repo after checkout %+v", repo)
+	}
+	ctl.fail = true
+	_, err = client.Refresh(ctx)
+	if err == nil || err.Error() != "resolve ref failed" {
+		t.Fatalf("Expect refresh error, got %v", err)
+	}
+	_, err = client.Checkout(ctx, "main")
+	if err == nil || err.Error() != "checkout failed" {
+		t.Fatalf("Expect checkout error, got %v", err)
+	}
+
+	level := logrus.GetLevel()
+	defer logrus.SetLevel(level)
+	err = client.SetLogLevel(ctx, "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logrus.GetLevel() != logrus.DebugLevel {
+		t.Fatalf("Expect debug log level, got %s", logrus.GetLevel())
+	}
+	err = client.SetLogLevel(ctx, "unknown")
+	if err == nil {
+		t.Fatal("Expect error for unknown log level")
+	}
+
+	err = client.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-server.ShutdownChan():
+	case <-time.After(time.Second):
+		t.Fatal("Expect shutdown to be requested")
+	}
+}
@@ -0,0 +1,92 @@
+package fs
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/fioncat/grfs/metrics"
+)
+
+// bufferPool tracks the content buffers held by nodes, and evicts the least
+// recently used ones when the total size exceeds the memory budget. Evicted
+// buffers will be fetched again on demand.
+type bufferPool struct {
+	maxSize int64
+	size    int64
+
+	lru *list.List
+
+	mu sync.Mutex
+}
+
+type bufferItem struct {
+	node *Node
+	size int64
+}
+
+func newBufferPool(maxSize int64) *bufferPool {
+	return &bufferPool{
+		maxSize: maxSize,
+		lru:     list.New(),
+	}
+}
+
+func (p *bufferPool) add(n *Node, size int64) {
+	p.mu.Lock()
+	if n.bufferElem != nil {
+		p.removeLocked(n)
+	}
+	n.bufferElem = p.lru.PushFront(&bufferItem{node: n, size: size})
+	p.size += size
+	metrics.SetBufferBytes(p.size)
+
+	var victims []*Node
+	for p.size > p.maxSize {
+		elem := p.lru.Back()
+		if elem == n.bufferElem {
+			// The buffer itself is larger than the budget, keep it since it
+			// is being used.
+			break
+		}
+		victim := elem.Value.(*bufferItem).node
+		p.removeLocked(victim)
+		victims = append(victims, victim)
+	}
+	p.mu.Unlock()
+
+	// Drop buffers without holding the pool lock, since nodes call the pool
+	// while holding their own locks.
+	for _, victim := range victims {
+		victim.logger.Debug("Evict content buffer")
+		victim.dropReader()
+	}
+}
+
+func (p *bufferPool) touch(n *Node) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n.bufferElem != nil {
+		p.lru.MoveToFront(n.bufferElem)
+	}
+}
+
+func (p *bufferPool) remove(n *Node) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n.bufferElem != nil {
+		p.removeLocked(n)
+	}
+}
+
+func (p *bufferPool) removeLocked(n *Node) {
+	item := p.lru.Remove(n.bufferElem).(*bufferItem)
+	p.size -= item.size
+	n.bufferElem = nil
+	metrics.SetBufferBytes(p.size)
+}
+
+func (p *bufferPool) getSize() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size
+}
@@ -0,0 +1,55 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/fioncat/grfs/types"
+)
+
+func TestBufferPool(t *testing.T) {
+	pool := newBufferPool(10)
+	shared := &nodeShared{buffers: pool}
+
+	nodes := make([]*Node, 4)
+	for i := range nodes {
+		n := newNode(&types.Entry{Path: fmt.Sprintf("file%d", i)}, shared)
+		n.reader = bytes.NewReader([]byte("abcd"))
+		nodes[i] = n
+	}
+
+	pool.add(nodes[0], 4)
+	pool.add(nodes[1], 4)
+	// Touch the first node, so the second one becomes the oldest
+	pool.touch(nodes[0])
+	pool.add(nodes[2], 4)
+
+	if nodes[1].reader != nil {
+		t.Fatal("Expect node 1 buffer to be evicted")
+	}
+	for _, i := range []int{0, 2} {
+		if nodes[i].reader == nil {
+			t.Fatalf("Expect node %d buffer to be kept", i)
+		}
+	}
+	if pool.size != 8 {
+		t.Fatalf("Unexpect pool size %d, expect 8", pool.size)
+	}
+
+	// The buffer larger than budget should be kept, others are evicted.
+	pool.add(nodes[3], 20)
+	for _, i := range []int{0, 2} {
+		if nodes[i].reader != nil {
+			t.Fatalf("Expect node %d buffer to be evicted", i)
+		}
+	}
+	if nodes[3].reader == nil {
+		t.Fatal("Expect node 3 buffer to be kept")
+	}
+
+	pool.remove(nodes[3])
+	if pool.size != 0 || pool.lru.Len() != 0 {
+		t.Fatalf("Expect pool to be empty, size %d, len %d", pool.size, pool.lru.Len())
+	}
+}
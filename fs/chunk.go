@@ -0,0 +1,77 @@
+package fs
+
+import (
+	"container/list"
+	"sync"
+)
+
+type chunkKey struct {
+	blob  string
+	index int64
+}
+
+type chunkItem struct {
+	key  chunkKey
+	data []byte
+}
+
+// chunkCache is a LRU cache for file chunks read by ranges, shared by all
+// nodes in the filesystem.
+type chunkCache struct {
+	maxSize int64
+	size    int64
+
+	items map[chunkKey]*list.Element
+	lru   *list.List
+
+	mu sync.Mutex
+}
+
+func newChunkCache(maxSize int64) *chunkCache {
+	return &chunkCache{
+		maxSize: maxSize,
+		items:   make(map[chunkKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *chunkCache) get(key chunkKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*chunkItem).data, true
+}
+
+func (c *chunkCache) put(key chunkKey, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		item := elem.Value.(*chunkItem)
+		c.size += int64(len(data)) - int64(len(item.data))
+		item.data = data
+		c.lru.MoveToFront(elem)
+	} else {
+		c.items[key] = c.lru.PushFront(&chunkItem{key: key, data: data})
+		c.size += int64(len(data))
+	}
+
+	for c.size > c.maxSize && c.lru.Len() > 1 {
+		elem := c.lru.Back()
+		item := elem.Value.(*chunkItem)
+		c.lru.Remove(elem)
+		delete(c.items, item.key)
+		c.size -= int64(len(item.data))
+	}
+}
+
+func (c *chunkCache) getSize() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
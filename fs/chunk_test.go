@@ -0,0 +1,114 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/fioncat/grfs/types"
+)
+
+func TestChunkCache(t *testing.T) {
+	cache := newChunkCache(10)
+	for i := 0; i < 5; i++ {
+		cache.put(chunkKey{blob: "test", index: int64(i)}, []byte("abc"))
+	}
+	if cache.size != 9 {
+		t.Fatalf("Unexpect cache size %d, expect 9", cache.size)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, ok := cache.get(chunkKey{blob: "test", index: int64(i)})
+		if ok {
+			t.Fatalf("Expect chunk %d to be evicted", i)
+		}
+	}
+	for i := 2; i < 5; i++ {
+		data, ok := cache.get(chunkKey{blob: "test", index: int64(i)})
+		if !ok {
+			t.Fatalf("Expect chunk %d in cache", i)
+		}
+		if string(data) != "abc" {
+			t.Fatalf("Unexpect chunk data %q", string(data))
+		}
+	}
+}
+
+type testRangeProvider struct {
+	testProvider
+
+	data  []byte
+	reads int
+}
+
+func (p *testRangeProvider) ReadFileRange(ctx context.Context, path string, off, length int64) ([]byte, error) {
+	p.reads++
+	if off >= int64(len(p.data)) {
+		return nil, fmt.Errorf("Range %d out of file", off)
+	}
+	end := off + length
+	if end > int64(len(p.data)) {
+		end = int64(len(p.data))
+	}
+	return p.data[off:end], nil
+}
+
+func TestReadRange(t *testing.T) {
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	p := &testRangeProvider{data: data}
+	root := NewNode(&types.Repository{}, p, nil, &types.Config{
+		Fs: &types.FilesystemConfig{
+			RangeReadThreshold: 10,
+			ChunkSize:          8,
+			ChunkCacheSize:     64,
+		},
+	})
+
+	n := newNode(&types.Entry{
+		Path: "large_file",
+		Name: "large_file",
+		Size: int64(len(data)),
+	}, root.shared)
+	fh, _, errno := n.Open(context.Background(), syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatalf("Open large file error: %v", errno)
+	}
+	f, ok := fh.(*rangeFile)
+	if !ok {
+		t.Fatal("Expect range reader for large file")
+	}
+
+	testCases := []struct {
+		off  int64
+		size int
+	}{
+		{0, 4},
+		{6, 10},
+		{7, 1},
+		{30, 20},
+		{0, 36},
+	}
+	for _, testCase := range testCases {
+		dest := make([]byte, testCase.size)
+		readn, err := f.readRange(context.Background(), dest, testCase.off)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		end := testCase.off + int64(testCase.size)
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		expect := data[testCase.off:end]
+		if !reflect.DeepEqual(dest[:readn], expect) {
+			t.Fatalf("Unexpect range data %q, expect %q", string(dest[:readn]), string(expect))
+		}
+	}
+
+	// 36 bytes with 8 bytes chunk, there are 5 chunks, all should be cached.
+	if p.reads != 5 {
+		t.Fatalf("Unexpect provider read count %d, expect 5", p.reads)
+	}
+}
@@ -0,0 +1,265 @@
+package fs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/fioncat/grfs/types"
+	"github.com/sirupsen/logrus"
+)
+
+// commitIndex holds the last commits of entries, which are used as the
+// modification times of entries.
+type commitIndex struct {
+	mode   string
+	reader types.CommitReader
+
+	mountTime time.Time
+	// ttl expires the loaded commits like the directory listings, unless the
+	// repository is pinned to a commit.
+	ttl time.Duration
+
+	ref         *types.Commit
+	refLoaded   bool
+	refLoadTime time.Time
+	// refLoading is closed when the running ref load is done, nil if no load
+	// is running.
+	refLoading chan struct{}
+
+	// commits holds the loaded last commits of paths. The index belongs to a
+	// revision, so the commits are reused by the listings of it.
+	commits map[string]cachedCommit
+	// loading holds the channels of the running loads for paths, they are
+	// closed when the loads are done.
+	loading map[string]chan struct{}
+	// timeout bounds the loads running in background.
+	timeout time.Duration
+
+	mu sync.Mutex
+}
+
+// cachedCommit is a loaded last commit, the commit is nil if the path has no
+// known commit.
+type cachedCommit struct {
+	commit   *types.Commit
+	loadTime time.Time
+}
+
+func newCommitIndex(provider types.Provider, repo *types.Repository, cfg *types.FilesystemConfig) *commitIndex {
+	c := &commitIndex{
+		mode:      cfg.ModTime,
+		mountTime: time.Now(),
+		commits:   make(map[string]cachedCommit),
+		loading:   make(map[string]chan struct{}),
+		timeout:   cfg.ReadDirTimeout,
+	}
+	if !repo.IsPinned() {
+		c.ttl = cfg.DirCacheTTL
+	}
+
+	reader, ok := provider.(types.CommitReader)
+	if ok {
+		c.reader = reader
+	} else if c.mode != types.ModTimeMount && c.mode != "" {
+		logrus.Warnf("The provider does not support reading commits, fallback modTime to %q", types.ModTimeMount)
+		c.mode = types.ModTimeMount
+	}
+
+	return c
+}
+
+// loadDir starts to read the last commits of sub entries in background after
+// listing a directory, only in "commit" mode. The listing does not wait for
+// them, the callers of getLastCommit do. The loaded paths are skipped.
+func (c *commitIndex) loadDir(ents []*types.Entry) {
+	if c.mode != types.ModTimeCommit || len(ents) == 0 {
+		return
+	}
+
+	paths := make([]string, 0, len(ents))
+	c.mu.Lock()
+	for _, ent := range ents {
+		if c.isKnown(ent.Path) {
+			continue
+		}
+		paths = append(paths, ent.Path)
+	}
+	done := c.startLoad(paths)
+	c.mu.Unlock()
+	if len(paths) == 0 {
+		return
+	}
+
+	go func() {
+		ctx, cancel := withTimeout(context.Background(), c.timeout)
+		defer cancel()
+		c.load(ctx, paths, done)
+	}()
+}
+
+// isKnown reports whether the commit of path is loaded or being loaded, it
+// should be called with mu held.
+func (c *commitIndex) isKnown(path string) bool {
+	if cached, ok := c.commits[path]; ok && !c.expired(cached.loadTime) {
+		return true
+	}
+	_, ok := c.loading[path]
+	return ok
+}
+
+func (c *commitIndex) expired(loadTime time.Time) bool {
+	return c.ttl > 0 && time.Since(loadTime) > c.ttl
+}
+
+// startLoad marks paths as loading, it should be called with mu held.
+func (c *commitIndex) startLoad(paths []string) chan struct{} {
+	done := make(chan struct{})
+	for _, path := range paths {
+		c.loading[path] = done
+	}
+	return done
+}
+
+// load reads the last commits of paths, and closes done after saving them.
+// Paths failed to read have no commit, except the interrupted ones, which are
+// read again by the next caller.
+func (c *commitIndex) load(ctx context.Context, paths []string, done chan struct{}) {
+	start := time.Now()
+	commits, err := c.reader.ReadLastCommits(ctx, paths)
+	if err != nil {
+		logrus.Warnf("Read last commits for %d entries error: %v", len(paths), err)
+	} else {
+		logrus.Debugf("Read last commits for %d entries done, took %v", len(paths), time.Since(start))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for _, path := range paths {
+		delete(c.loading, path)
+		if err != nil && ctx.Err() != nil {
+			continue
+		}
+		c.commits[path] = cachedCommit{commit: commits[path], loadTime: now}
+	}
+	close(done)
+}
+
+func (c *commitIndex) getModTime(ctx context.Context, path string) time.Time {
+	switch c.mode {
+	case types.ModTimeCommit:
+		if path == "" {
+			return c.getRefTime(ctx)
+		}
+		commit := c.getCommit(ctx, path)
+		if commit != nil {
+			return commit.Time
+		}
+		return c.mountTime
+
+	case types.ModTimeRef:
+		return c.getRefTime(ctx)
+
+	default:
+		return c.mountTime
+	}
+}
+
+func (c *commitIndex) getRefTime(ctx context.Context) time.Time {
+	ref := c.getRef(ctx)
+	if ref == nil {
+		return c.mountTime
+	}
+	return ref.Time
+}
+
+func (c *commitIndex) getRef(ctx context.Context) *types.Commit {
+	c.mu.Lock()
+	for !c.isRefLoaded() && c.refLoading != nil {
+		// Wait for the running load rather than sending the same request.
+		loading := c.refLoading
+		c.mu.Unlock()
+		select {
+		case <-loading:
+		case <-ctx.Done():
+			return nil
+		}
+		c.mu.Lock()
+	}
+	if c.isRefLoaded() {
+		ref := c.ref
+		c.mu.Unlock()
+		return ref
+	}
+	loading := make(chan struct{})
+	c.refLoading = loading
+	c.mu.Unlock()
+
+	commits, err := c.reader.ReadLastCommits(ctx, []string{""})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refLoading = nil
+	close(loading)
+	switch {
+	case err == nil:
+		c.ref = commits[""]
+		c.refLoaded, c.refLoadTime = true, time.Now()
+	case ctx.Err() != nil:
+		// The request was interrupted, read again by the next caller.
+	default:
+		logrus.Warnf("Read ref commit error: %v", err)
+		c.refLoaded, c.refLoadTime = true, time.Now()
+	}
+	return c.ref
+}
+
+// isRefLoaded reports whether the ref commit is loaded and not expired, it
+// should be called with mu held.
+func (c *commitIndex) isRefLoaded() bool {
+	return c.refLoaded && !c.expired(c.refLoadTime)
+}
+
+// getLastCommit returns the last commit of an entry, only available in
+// "commit" mode. Returns nil if it is unknown.
+func (c *commitIndex) getLastCommit(ctx context.Context, path string) *types.Commit {
+	if c.mode != types.ModTimeCommit {
+		return nil
+	}
+	if path == "" {
+		return c.getRef(ctx)
+	}
+	return c.getCommit(ctx, path)
+}
+
+// getCommit returns the last commit of path. It waits for the running load
+// of path, or reads it on demand if the directory was not listed.
+func (c *commitIndex) getCommit(ctx context.Context, path string) *types.Commit {
+	c.mu.Lock()
+	for {
+		if cached, ok := c.commits[path]; ok && !c.expired(cached.loadTime) {
+			c.mu.Unlock()
+			return cached.commit
+		}
+		loading, ok := c.loading[path]
+		if !ok {
+			break
+		}
+		c.mu.Unlock()
+		select {
+		case <-loading:
+		case <-ctx.Done():
+			return nil
+		}
+		c.mu.Lock()
+	}
+	done := c.startLoad([]string{path})
+	c.mu.Unlock()
+
+	c.load(ctx, []string{path}, done)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.commits[path].commit
+}
@@ -0,0 +1,227 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fioncat/grfs/types"
+)
+
+type testCommitProvider struct {
+	testProvider
+
+	commits map[string]*types.Commit
+	reads   atomic.Int32
+
+	// block makes ReadLastCommits wait until it is closed.
+	block chan struct{}
+}
+
+func (p *testCommitProvider) ReadLastCommits(ctx context.Context, paths []string) (map[string]*types.Commit, error) {
+	p.reads.Add(1)
+	if p.block != nil {
+		select {
+		case <-p.block:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	result := make(map[string]*types.Commit, len(paths))
+	for _, path := range paths {
+		if commit, ok := p.commits[path]; ok {
+			result[path] = commit
+		}
+	}
+	return result, nil
+}
+
+var testCommitRepo = &types.Repository{Ref: "main"}
+
+func TestCommitIndex(t *testing.T) {
+	refTime := time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC)
+	fileTime := time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC)
+	p := &testCommitProvider{
+		commits: map[string]*types.Commit{
+			"":          {SHA: "ref", Time: refTime},
+			"README.md": {SHA: "file", Time: fileTime},
+		},
+	}
+	ents := []*types.Entry{
+		{Path: "README.md", Name: "README.md"},
+		{Path: "unknown", Name: "unknown"},
+	}
+	ctx := context.Background()
+
+	index := newCommitIndex(p, testCommitRepo, &types.FilesystemConfig{ModTime: types.ModTimeMount})
+	index.loadDir(ents)
+	if mtime := index.getModTime(ctx, "README.md"); !mtime.Equal(index.mountTime) {
+		t.Fatalf("Expect mount time in mount mode, got %v", mtime)
+	}
+	if p.reads.Load() != 0 {
+		t.Fatalf("Expect no reads in mount mode, read %d", p.reads.Load())
+	}
+
+	index = newCommitIndex(p, testCommitRepo, &types.FilesystemConfig{ModTime: types.ModTimeRef})
+	for _, path := range []string{"", "README.md"} {
+		if mtime := index.getModTime(ctx, path); !mtime.Equal(refTime) {
+			t.Fatalf("Expect ref time in ref mode for %q, got %v", path, mtime)
+		}
+	}
+	if p.reads.Load() != 1 {
+		t.Fatalf("Expect ref commit to be read once, read %d", p.reads.Load())
+	}
+
+	index = newCommitIndex(p, testCommitRepo, &types.FilesystemConfig{ModTime: types.ModTimeCommit})
+	index.loadDir(ents)
+	if mtime := index.getModTime(ctx, "README.md"); !mtime.Equal(fileTime) {
+		t.Fatalf("Expect file commit time in commit mode, got %v", mtime)
+	}
+	if mtime := index.getModTime(ctx, "unknown"); !mtime.Equal(index.mountTime) {
+		t.Fatalf("Expect fallback to mount time for unknown commit, got %v", mtime)
+	}
+	if mtime := index.getModTime(ctx, ""); !mtime.Equal(refTime) {
+		t.Fatalf("Expect ref time for root in commit mode, got %v", mtime)
+	}
+}
+
+func TestCommitIndexRefLoading(t *testing.T) {
+	refTime := time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC)
+	p := &testCommitProvider{
+		commits: map[string]*types.Commit{
+			"": {SHA: "ref", Time: refTime},
+		},
+		block: make(chan struct{}),
+	}
+	index := newCommitIndex(p, testCommitRepo, &types.FilesystemConfig{ModTime: types.ModTimeCommit})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if mtime := index.getModTime(context.Background(), ""); !mtime.Equal(refTime) {
+				t.Errorf("Expect ref time, got %v", mtime)
+			}
+		}()
+	}
+	for p.reads.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The index should not be locked during the request, the unknown path is
+	// read on demand, and falls back to mount time when interrupted.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	if mtime := index.getModTime(ctx, "README.md"); !mtime.Equal(index.mountTime) {
+		t.Fatalf("Expect mount time for unknown commit, got %v", mtime)
+	}
+	cancel()
+	// The waiting caller can be interrupted.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if commit := index.getRef(ctx); commit != nil || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		t.Fatalf("Expect interrupted caller to get nothing, got %v", commit)
+	}
+
+	close(p.block)
+	wg.Wait()
+	// The ref commit is read once, and README.md is read on demand.
+	if p.reads.Load() != 2 {
+		t.Fatalf("Unexpect read count %d, expect 2", p.reads.Load())
+	}
+}
+
+func TestCommitIndexLoadDir(t *testing.T) {
+	fileTime := time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC)
+	p := &testCommitProvider{
+		commits: map[string]*types.Commit{
+			"README.md": {SHA: "file", Time: fileTime},
+		},
+		block: make(chan struct{}),
+	}
+	ents := []*types.Entry{
+		{Path: "README.md", Name: "README.md"},
+		{Path: "unknown", Name: "unknown"},
+	}
+	index := newCommitIndex(p, testCommitRepo, &types.FilesystemConfig{ModTime: types.ModTimeCommit})
+
+	// The listing does not wait for the commits.
+	index.loadDir(ents)
+	// Listing again should not read the loading paths again.
+	index.loadDir(ents)
+
+	ctx := context.Background()
+	go func() {
+		for p.reads.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		close(p.block)
+	}()
+	if mtime := index.getModTime(ctx, "README.md"); !mtime.Equal(fileTime) {
+		t.Fatalf("Expect file commit time after loaded, got %v", mtime)
+	}
+	if mtime := index.getModTime(ctx, "unknown"); !mtime.Equal(index.mountTime) {
+		t.Fatalf("Expect fallback to mount time for unknown commit, got %v", mtime)
+	}
+
+	// The loaded commits are reused by the later listings.
+	index.loadDir(ents)
+	if p.reads.Load() != 1 {
+		t.Fatalf("Expect commits to be read once, read %d", p.reads.Load())
+	}
+}
+
+func TestCommitIndexExpire(t *testing.T) {
+	oldTime := time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC)
+	newTime := time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC)
+	p := &testCommitProvider{
+		commits: map[string]*types.Commit{
+			"":          {SHA: "ref", Time: oldTime},
+			"README.md": {SHA: "file", Time: oldTime},
+		},
+	}
+	ents := []*types.Entry{{Path: "README.md", Name: "README.md"}}
+	cfg := &types.FilesystemConfig{
+		ModTime:     types.ModTimeCommit,
+		DirCacheTTL: time.Millisecond * 50,
+	}
+	ctx := context.Background()
+
+	index := newCommitIndex(p, testCommitRepo, cfg)
+	pinned := newCommitIndex(p, &types.Repository{Ref: "abc", Commit: "abc"}, cfg)
+	for _, index := range []*commitIndex{index, pinned} {
+		index.loadDir(ents)
+		for _, path := range []string{"", "README.md"} {
+			if mtime := index.getModTime(ctx, path); !mtime.Equal(oldTime) {
+				t.Fatalf("Expect commit time of %q, got %v", path, mtime)
+			}
+		}
+	}
+
+	p.commits[""] = &types.Commit{SHA: "new-ref", Time: newTime}
+	p.commits["README.md"] = &types.Commit{SHA: "new-file", Time: newTime}
+	time.Sleep(time.Millisecond * 60)
+	reads := p.reads.Load()
+
+	// The commits expire like the listings, except the pinned ones.
+	index.loadDir(ents)
+	for _, path := range []string{"", "README.md"} {
+		if mtime := index.getModTime(ctx, path); !mtime.Equal(newTime) {
+			t.Fatalf("Expect new commit time of %q after expired, got %v", path, mtime)
+		}
+	}
+	if n := p.reads.Load() - reads; n != 2 {
+		t.Fatalf("Expect expired commits to be read again, read %d", n)
+	}
+	reads = p.reads.Load()
+	pinned.loadDir(ents)
+	if mtime := pinned.getModTime(ctx, "README.md"); !mtime.Equal(oldTime) {
+		t.Fatalf("Expect pinned commit not to expire, got %v", mtime)
+	}
+	if n := p.reads.Load() - reads; n != 0 {
+		t.Fatalf("Expect pinned commits not to be read again, read %d", n)
+	}
+}
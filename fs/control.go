@@ -0,0 +1,402 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/fioncat/grfs/types"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	_ = (fusefs.NodeReaddirer)((*controlDir)(nil))
+	_ = (fusefs.NodeLookuper)((*controlDir)(nil))
+	_ = (fusefs.NodeGetattrer)((*controlDir)(nil))
+
+	_ = (fusefs.NodeGetattrer)((*controlFile)(nil))
+	_ = (fusefs.NodeSetattrer)((*controlFile)(nil))
+	_ = (fusefs.NodeOpener)((*controlFile)(nil))
+	_ = (fusefs.NodeReader)((*controlFile)(nil))
+	_ = (fusefs.NodeWriter)((*controlFile)(nil))
+)
+
+// controlDir is the virtual directory in the mount root. Its files can be read
+// to inspect the filesystem, or written to control it.
+type controlDir struct {
+	fusefs.Inode
+	readOnlyNode
+
+	root *Node
+	// ctrl is the controller of the mount root, which is the RefsNode in
+	// multi-ref layout.
+	ctrl types.DaemonController
+}
+
+// controlFile is a file in the control directory. It is read-only if write
+// is nil, and write-only if read is nil.
+type controlFile struct {
+	fusefs.Inode
+
+	root *Node
+
+	name  string
+	read  func() string
+	write func(ctx context.Context, value string) error
+}
+
+// controlHandle holds the content of a control file when it is opened, so
+// that the reads of one open see a consistent snapshot.
+type controlHandle struct {
+	data []byte
+}
+
+var errEmptyRef = errors.New("the ref to checkout is empty")
+
+func (n *Node) controlFiles(ctrl types.DaemonController) []*controlFile {
+	s := n.shared
+	files := []*controlFile{
+		{name: "repo", read: func() string {
+			repo := s.current().repo
+			return fmt.Sprintf("%s:%s\n", repo.Domain, repo.Path())
+		}},
+		{name: "ref", read: func() string { return s.current().repo.Ref + "\n" }},
+		{name: "commit", read: func() string { return s.current().repo.Commit + "\n" }},
+		{name: "stats", read: s.formatStats},
+		{name: "errors", read: s.errors.format},
+	}
+	if s.cfg.ControlWritable {
+		files = append(files, &controlFile{name: "refresh", write: func(ctx context.Context, _ string) error {
+			return ctrl.Refresh(ctx)
+		}}, &controlFile{name: "checkout", write: func(ctx context.Context, ref string) error {
+			return n.checkoutByControl(ctx, ctrl, ref)
+		}})
+	}
+	for _, file := range files {
+		file.root = n
+	}
+	return files
+}
+
+func (n *Node) Repository() *types.Repository {
+	repo := *n.shared.current().repo
+	return &repo
+}
+
+func (n *Node) Stats() *types.FilesystemStats {
+	return n.shared.getStats()
+}
+
+// Refresh drops the caches of the mounted repository, see refresh.
+func (n *Node) Refresh(ctx context.Context) error {
+	err := n.shared.refresh(ctx)
+	if err != nil {
+		return err
+	}
+	n.relistRoot(ctx)
+	return nil
+}
+
+// Checkout switches the mounted repository to ref, see checkout.
+func (n *Node) Checkout(ctx context.Context, ref string) error {
+	err := n.shared.checkout(ctx, ref)
+	if err != nil {
+		return err
+	}
+	n.relistRoot(ctx)
+	return nil
+}
+
+// SetRepoSaver sets the function to save the repository checked out by the
+// control file, such as updating the mountpoint metadata. The checkouts by
+// the control socket are saved by the CLI.
+func (n *Node) SetRepoSaver(save func(repo *types.Repository) error) {
+	n.shared.saveRepo = save
+}
+
+func (n *Node) checkoutByControl(ctx context.Context, ctrl types.DaemonController, ref string) error {
+	err := ctrl.Checkout(ctx, ref)
+	if err != nil {
+		return err
+	}
+	if n.shared.saveRepo == nil {
+		return nil
+	}
+	err = n.shared.saveRepo(ctrl.Repository())
+	if err != nil {
+		return fmt.Errorf("save checked out repository: %w", err)
+	}
+	return nil
+}
+
+// Close stops the background prefetching, it is called after unmounting.
+func (n *Node) Close() error {
+	n.shared.prefetcher.stop()
+	return nil
+}
+
+// relistRoot lists the root again after refreshing. The changed entries are
+// removed, and the kernel is told to forget them. Since the tree SHA changes
+// with any of its descendants, the stale sub trees are all dropped.
+func (n *Node) relistRoot(ctx context.Context) {
+	if n.shared.current().repo.MultiRef {
+		// The root is not mounted in multi-ref layout.
+		return
+	}
+	_, err := n.listSubEntries(ctx)
+	if err != nil {
+		n.logError("List root entries after refreshing", err)
+	}
+}
+
+func (n *Node) controlDirEntry() fuse.DirEntry {
+	return fuse.DirEntry{
+		Mode: syscall.S_IFDIR | 0555,
+		Name: n.shared.cfg.ControlDir,
+		Ino:  n.shared.inodes.get(n.shared.cfg.ControlDir),
+	}
+}
+
+// lookupControlDir returns the control directory under parent, which is the
+// inode of the mount root, controlled by ctrl.
+func (n *Node) lookupControlDir(ctx context.Context, parent *fusefs.Inode, ctrl types.DaemonController, out *fuse.EntryOut) *fusefs.Inode {
+	dir := &controlDir{root: n, ctrl: ctrl}
+	dir.fillAttr(&out.Attr)
+	if child := parent.GetChild(n.shared.cfg.ControlDir); child != nil {
+		return child
+	}
+	return parent.NewInode(ctx, dir, fusefs.StableAttr{
+		Mode: syscall.S_IFDIR,
+		Ino:  out.Attr.Ino,
+	})
+}
+
+func (d *controlDir) fillAttr(out *fuse.Attr) {
+	ent := d.root.controlDirEntry()
+	out.Ino = ent.Ino
+	out.Mode = ent.Mode
+	out.Owner = d.root.getOwner()
+
+	startTime := d.root.shared.stats.startTime
+	out.SetTimes(nil, &startTime, &startTime)
+}
+
+func (d *controlDir) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	d.fillAttr(&out.Attr)
+	return 0
+}
+
+func (d *controlDir) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
+	files := d.root.controlFiles(d.ctrl)
+	ents := make([]fuse.DirEntry, len(files))
+	for i, file := range files {
+		ents[i] = fuse.DirEntry{
+			Mode: file.getMode(),
+			Name: file.name,
+			Ino:  file.getIno(),
+		}
+	}
+	return fusefs.NewListDirStream(ents), 0
+}
+
+func (d *controlDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	for _, file := range d.root.controlFiles(d.ctrl) {
+		if file.name != name {
+			continue
+		}
+		file.fillAttr(&out.Attr)
+		if child := d.GetChild(name); child != nil {
+			return child, 0
+		}
+		return d.NewInode(ctx, file, fusefs.StableAttr{
+			Mode: syscall.S_IFREG,
+			Ino:  out.Attr.Ino,
+		}), 0
+	}
+	return nil, syscall.ENOENT
+}
+
+func (f *controlFile) getIno() uint64 {
+	return f.root.shared.inodes.get(path.Join(f.root.shared.cfg.ControlDir, f.name))
+}
+
+func (f *controlFile) getMode() uint32 {
+	var mode uint32
+	if f.read != nil {
+		mode |= 0444
+	}
+	if f.write != nil {
+		mode |= 0200
+	}
+	return mode | syscall.S_IFREG
+}
+
+func (f *controlFile) fillAttr(out *fuse.Attr) {
+	// The content is generated when opening, the size is unknown.
+	out.Ino = f.getIno()
+	out.Mode = f.getMode()
+	out.Owner = f.root.getOwner()
+
+	now := time.Now()
+	out.SetTimes(nil, &now, &now)
+}
+
+func (f *controlFile) Getattr(ctx context.Context, fh fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	f.fillAttr(&out.Attr)
+	return 0
+}
+
+func (f *controlFile) Setattr(ctx context.Context, fh fusefs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	// Allow truncating by shell redirections, the content is not stored.
+	if _, ok := in.GetSize(); ok && f.write == nil {
+		return syscall.EACCES
+	}
+	f.fillAttr(&out.Attr)
+	return 0
+}
+
+func (f *controlFile) Open(ctx context.Context, flags uint32) (fusefs.FileHandle, uint32, syscall.Errno) {
+	accMode := flags & syscall.O_ACCMODE
+	if accMode != syscall.O_WRONLY && f.read == nil {
+		return nil, 0, syscall.EACCES
+	}
+	if accMode != syscall.O_RDONLY && f.write == nil {
+		return nil, 0, syscall.EACCES
+	}
+
+	handle := new(controlHandle)
+	if f.read != nil && accMode != syscall.O_WRONLY {
+		handle.data = []byte(f.read())
+	}
+	return handle, fuse.FOPEN_DIRECT_IO, 0
+}
+
+func (f *controlFile) Read(ctx context.Context, fh fusefs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	handle, ok := fh.(*controlHandle)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	if off >= int64(len(handle.data)) {
+		return fuse.ReadResultData(nil), 0
+	}
+	readn := copy(dest, handle.data[off:])
+	return fuse.ReadResultData(dest[:readn]), 0
+}
+
+func (f *controlFile) Write(ctx context.Context, fh fusefs.FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	if f.write == nil {
+		return 0, syscall.EACCES
+	}
+
+	value := strings.TrimSpace(string(data))
+	err := f.write(ctx, value)
+	if err != nil {
+		shared := f.root.shared
+		logrus.Errorf("Write control file %q error: %v", f.name, err)
+		shared.stats.errors.Add(1)
+		shared.errors.add(path.Join(shared.cfg.ControlDir, f.name), err)
+		if errors.Is(err, errEmptyRef) {
+			return 0, syscall.EINVAL
+		}
+		return 0, providerErrno(err)
+	}
+	return uint32(len(data)), 0
+}
+
+// refresh drops the directory caches, so that the upstream changes can be
+// seen. If the repository is not pinned, its ref is resolved again.
+func (s *nodeShared) refresh(ctx context.Context) error {
+	s.checkoutMu.Lock()
+	defer s.checkoutMu.Unlock()
+
+	state := s.current()
+	if state.repo.IsPinned() {
+		s.setState(state.repo, state.provider)
+		logrus.Infof("Refresh %s, commit %s", state.repo.String(), state.repo.Commit)
+		return nil
+	}
+
+	repo := *state.repo
+	err := s.resolveState(ctx, &repo)
+	if err != nil {
+		return fmt.Errorf("resolve ref %q: %w", repo.Ref, err)
+	}
+	logrus.Infof("Refresh %s, commit %s", repo.String(), repo.Commit)
+	return nil
+}
+
+// checkout switches the mounted repository to another ref.
+func (s *nodeShared) checkout(ctx context.Context, ref string) error {
+	if ref == "" {
+		return errEmptyRef
+	}
+
+	s.checkoutMu.Lock()
+	defer s.checkoutMu.Unlock()
+
+	repo := *s.current().repo
+	if repo.MultiRef {
+		return errors.New("checkout is not supported in multi-ref layout")
+	}
+	repo.Ref, repo.Commit = ref, ""
+	err := s.resolveState(ctx, &repo)
+	if err != nil {
+		return fmt.Errorf("checkout %q: %w", ref, err)
+	}
+	logrus.Infof("Checkout %s, commit %s", repo.String(), repo.Commit)
+	return nil
+}
+
+// resolveState resolves the ref of repo by a new provider, and then switches
+// to it. The current state is kept if failed.
+func (s *nodeShared) resolveState(ctx context.Context, repo *types.Repository) error {
+	prov, err := s.loadProvider(repo)
+	if err != nil {
+		return fmt.Errorf("load provider: %w", err)
+	}
+	err = prov.Check(ctx)
+	if err != nil {
+		return err
+	}
+	s.setState(repo, prov)
+	return nil
+}
+
+// setState replaces the current state with fresh indexes, and expires the
+// directory caches loaded from the old one.
+func (s *nodeShared) setState(repo *types.Repository, prov types.Provider) {
+	s.state.Store(s.newState(repo, prov))
+	s.prefetcher.reset()
+	s.inodes.reset()
+	s.gen.Add(1)
+}
+
+func (s *nodeShared) formatStats() string {
+	stats := s.getStats()
+	var sb strings.Builder
+	write := func(name string, value interface{}) {
+		fmt.Fprintf(&sb, "%s: %v\n", name, value)
+	}
+
+	write("uptime", time.Since(s.stats.startTime).Round(time.Second))
+	write("read_dirs", stats.ReadDirs)
+	write("read_files", stats.ReadFiles)
+	write("read_ranges", stats.ReadRanges)
+	write("download_bytes", stats.DownloadBytes)
+	write("blob_cache_hits", stats.CacheHits)
+	write("blob_cache_misses", stats.CacheMisses)
+	write("buffer_size", humanize.IBytes(uint64(stats.BufferSize)))
+	write("chunk_cache_size", humanize.IBytes(uint64(stats.ChunkCacheSize)))
+	write("errors", stats.Errors)
+	if stats.RateLimit != nil {
+		write("rate_limit", stats.RateLimit)
+	}
+	return sb.String()
+}
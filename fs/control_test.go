@@ -0,0 +1,253 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/fioncat/grfs/types"
+)
+
+type testRefProvider struct {
+	testProvider
+
+	repo *types.Repository
+	refs map[string]string
+}
+
+func (p *testRefProvider) Check(ctx context.Context) error {
+	if p.repo.IsPinned() {
+		return nil
+	}
+	commit, ok := p.refs[p.repo.Ref]
+	if !ok {
+		return errors.New("ref not found")
+	}
+	p.repo.Commit = commit
+	return nil
+}
+
+func readControlFile(t *testing.T, f *controlFile) string {
+	fh, _, errno := f.Open(context.Background(), syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatalf("Open control file %q: %v", f.name, errno)
+	}
+	buf := make([]byte, 4096)
+	result, errno := f.Read(context.Background(), fh, buf, 0)
+	if errno != 0 {
+		t.Fatalf("Read control file %q: %v", f.name, errno)
+	}
+	data, _ := result.Bytes(buf)
+	return string(data)
+}
+
+func writeControlFile(f *controlFile, value string) syscall.Errno {
+	fh, _, errno := f.Open(context.Background(), syscall.O_WRONLY|syscall.O_TRUNC)
+	if errno != 0 {
+		return errno
+	}
+	_, errno = f.Write(context.Background(), fh, []byte(value), 0)
+	return errno
+}
+
+func TestControlFiles(t *testing.T) {
+	repo := &types.Repository{
+		Domain: "github.com",
+		Owner:  "fioncat",
+		Name:   "grfs",
+		Ref:    "main",
+		Commit: "c1",
+	}
+	p := &testRefProvider{
+		repo: repo,
+		refs: map[string]string{"main": "c1", "dev": "c2"},
+	}
+	root := NewNode(repo, p, nil, &types.Config{Fs: &types.FilesystemConfig{
+		ControlDir:      ".grfs",
+		ControlWritable: true,
+	}})
+	root.shared.loadProvider = func(repo *types.Repository) (types.Provider, error) {
+		return &testRefProvider{repo: repo, refs: p.refs}, nil
+	}
+
+	var saved *types.Repository
+	root.SetRepoSaver(func(repo *types.Repository) error {
+		saved = repo
+		return nil
+	})
+
+	files := make(map[string]*controlFile)
+	for _, f := range root.controlFiles(root) {
+		files[f.name] = f
+	}
+
+	expect := map[string]string{
+		"repo":   "github.com:fioncat/grfs\n",
+		"ref":    "main\n",
+		"commit": "c1\n",
+	}
+	for name, value := range expect {
+		if data := readControlFile(t, files[name]); data != value {
+			t.Fatalf("Unexpect content %q for %q, expect %q", data, name, value)
+		}
+	}
+
+	if _, _, errno := files["ref"].Open(context.Background(), syscall.O_WRONLY); errno != syscall.EACCES {
+		t.Fatalf("Expect EACCES when writing read-only file, got %v", errno)
+	}
+	if _, _, errno := files["checkout"].Open(context.Background(), syscall.O_RDONLY); errno != syscall.EACCES {
+		t.Fatalf("Expect EACCES when reading write-only file, got %v", errno)
+	}
+
+	gen := root.shared.gen.Load()
+	if errno := writeControlFile(files["checkout"], "dev\n"); errno != 0 {
+		t.Fatalf("Checkout dev: %v", errno)
+	}
+	if current := root.Repository(); current.Ref != "dev" || current.Commit != "c2" {
+		t.Fatalf("Unexpect repo after checkout: %s, %s", current.Ref, current.Commit)
+	}
+	if repo.Ref != "main" || repo.Commit != "c1" {
+		t.Fatalf("Expect the old repo not to be modified: %s, %s", repo.Ref, repo.Commit)
+	}
+	if root.shared.gen.Load() == gen {
+		t.Fatal("Expect caches to be reset after checkout")
+	}
+	if saved == nil || saved.Ref != "dev" || saved.Commit != "c2" {
+		t.Fatalf("Expect the checked out repo to be saved, got %+v", saved)
+	}
+	// The mount is writable, the repository nodes should reject writes.
+	if _, _, _, errno := root.Create(context.Background(), "new.txt", 0, 0644, nil); errno != syscall.EROFS {
+		t.Fatalf("Expect EROFS when creating file, got %v", errno)
+	}
+
+	if errno := writeControlFile(files["checkout"], "unknown"); errno != syscall.EIO {
+		t.Fatalf("Expect EIO when checking out unknown ref, got %v", errno)
+	}
+	if current := root.Repository(); current.Ref != "dev" || current.Commit != "c2" {
+		t.Fatalf("Expect repo to be kept after failed checkout: %s, %s", current.Ref, current.Commit)
+	}
+	if errno := writeControlFile(files["checkout"], "\n"); errno != syscall.EINVAL {
+		t.Fatalf("Expect EINVAL when checking out empty ref, got %v", errno)
+	}
+
+	errs := readControlFile(t, files["errors"])
+	if lines := strings.Split(strings.TrimSpace(errs), "\n"); len(lines) != 2 {
+		t.Fatalf("Unexpect errors %q", errs)
+	}
+	if stats := readControlFile(t, files["stats"]); !strings.Contains(stats, "errors: 2\n") {
+		t.Fatalf("Unexpect stats %q", stats)
+	}
+
+	gen = root.shared.gen.Load()
+	if errno := writeControlFile(files["refresh"], "1"); errno != 0 {
+		t.Fatalf("Refresh: %v", errno)
+	}
+	if root.shared.gen.Load() == gen {
+		t.Fatal("Expect caches to be reset after refresh")
+	}
+}
+
+func TestControlFilesReadOnly(t *testing.T) {
+	root := NewNode(&types.Repository{Ref: "main"}, &testProvider{}, nil,
+		&types.Config{Fs: &types.FilesystemConfig{ControlDir: ".grfs"}})
+	for _, f := range root.controlFiles(root) {
+		if f.write != nil {
+			t.Fatalf("Expect no writable control file by default, got %q", f.name)
+		}
+	}
+}
+
+func TestControlCheckoutConcurrent(t *testing.T) {
+	repo := &types.Repository{
+		Domain: "github.com",
+		Owner:  "fioncat",
+		Name:   "grfs",
+		Ref:    "main",
+		Commit: "c1",
+	}
+	refs := map[string]string{"main": "c1", "dev": "c2"}
+	p := &testRefProvider{repo: repo, refs: refs}
+	root := NewNode(repo, p, nil, &types.Config{Fs: &types.FilesystemConfig{ControlDir: ".grfs"}})
+	root.shared.loadProvider = func(repo *types.Repository) (types.Provider, error) {
+		return &testRefProvider{repo: repo, refs: refs}, nil
+	}
+
+	ctx := context.Background()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// The ref and commit of a state always match.
+				state := root.shared.current()
+				if refs[state.repo.Ref] != state.repo.Revision() {
+					t.Errorf("Inconsistent state %s, %s", state.repo.Ref, state.repo.Commit)
+					return
+				}
+				_, err := root.listSubEntries(ctx)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				root.getXattrs(ctx)
+			}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		ref := "dev"
+		if i%2 == 1 {
+			ref = "main"
+		}
+		if err := root.shared.checkout(ctx, ref); err != nil {
+			t.Fatal(err)
+		}
+		if err := root.shared.refresh(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if current := root.Repository(); current.Ref != "main" || current.Commit != "c1" {
+		t.Fatalf("Unexpect repo after checkout: %s, %s", current.Ref, current.Commit)
+	}
+}
+
+func TestControlDirClash(t *testing.T) {
+	p := &testProvider{ents: []*testEntry{
+		{info: &types.Entry{Path: ".grfs", Name: ".grfs"}, data: []byte("clash")},
+		{info: &types.Entry{Path: "main.go", Name: "main.go"}, data: []byte("package main")},
+	}}
+	root := NewNode(&types.Repository{Ref: "main"}, p, nil,
+		&types.Config{Fs: &types.FilesystemConfig{ControlDir: ".grfs"}})
+
+	stream, errno := root.Readdir(context.Background())
+	if errno != 0 {
+		t.Fatalf("Readdir: %v", errno)
+	}
+	var names []string
+	for stream.HasNext() {
+		ent, errno := stream.Next()
+		if errno != 0 {
+			t.Fatalf("Read dir stream: %v", errno)
+		}
+		if ent.Name == ".grfs" && ent.Mode&syscall.S_IFDIR == 0 {
+			t.Fatal("Expect the clashing entry to be replaced by the control directory")
+		}
+		names = append(names, ent.Name)
+	}
+	if len(names) != 2 || names[0] != "main.go" || names[1] != ".grfs" {
+		t.Fatalf("Unexpect root entries %v", names)
+	}
+}
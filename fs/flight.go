@@ -0,0 +1,85 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// flightGroup coalesces the concurrent provider calls with the same key, the
+// callers share the result of one call. The call runs with its own context,
+// which is cancelled once all the waiting callers are gone, so an interrupted
+// caller does not fail the others.
+type flightGroup struct {
+	calls map[string]*flightCall
+
+	mu sync.Mutex
+}
+
+type flightCall struct {
+	done chan struct{}
+
+	val interface{}
+	err error
+
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[string]*flightCall)}
+}
+
+func (g *flightGroup) do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	call, ok := g.calls[key]
+	if !ok {
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &flightCall{
+			done:   make(chan struct{}),
+			cancel: cancel,
+		}
+		g.calls[key] = call
+
+		go func() {
+			call.val, call.err = fn(callCtx)
+			cancel()
+
+			g.mu.Lock()
+			g.removeLocked(key, call)
+			g.mu.Unlock()
+			close(call.done)
+		}()
+	}
+	call.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.val, call.err
+
+	case <-ctx.Done():
+		g.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// The new callers should not join the cancelled call.
+			g.removeLocked(key, call)
+			call.cancel()
+		}
+		g.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (g *flightGroup) removeLocked(key string, call *flightCall) {
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+}
+
+// flightKey returns the key of a provider call on path, the calls on the
+// same state are coalesced.
+func (st *repoState) flightKey(kind, path string) string {
+	return fmt.Sprintf("%s %s:%s/%s@%s#%d %s", kind, st.repo.Domain, st.repo.Owner, st.repo.Name,
+		st.repo.Revision(), st.id, path)
+}
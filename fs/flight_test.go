@@ -0,0 +1,170 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fioncat/grfs/types"
+)
+
+func TestFlightGroup(t *testing.T) {
+	g := newFlightGroup()
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		calls.Add(1)
+		select {
+		case <-release:
+			return "done", nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			val, err := g.do(context.Background(), "key", fn)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = val
+		}(i)
+	}
+
+	// The interrupted caller should not fail the others.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	_, err := g.do(ctx, "key", fn)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expect deadline exceeded, got %v", err)
+	}
+
+	close(release)
+	wg.Wait()
+	if calls.Load() != 1 {
+		t.Fatalf("Expect 1 call, got %d", calls.Load())
+	}
+	for _, val := range results {
+		if val != "done" {
+			t.Fatalf("Unexpect result %v", val)
+		}
+	}
+}
+
+func TestFlightGroupCancel(t *testing.T) {
+	g := newFlightGroup()
+
+	cancelled := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		cancel()
+	}()
+	_, err := g.do(ctx, "key", func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expect canceled, got %v", err)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("Expect the call to be cancelled after all callers are gone")
+	}
+
+	// The new caller starts a new call.
+	val, err := g.do(context.Background(), "key", func(ctx context.Context) (interface{}, error) {
+		return "new", nil
+	})
+	if err != nil || val != "new" {
+		t.Fatalf("Unexpect result %v, %v", val, err)
+	}
+}
+
+type testListProvider struct {
+	testCommitProvider
+
+	readDirs atomic.Int32
+	release  chan struct{}
+}
+
+func (p *testListProvider) ReadDir(ctx context.Context, path string) ([]*types.Entry, error) {
+	p.readDirs.Add(1)
+	select {
+	case <-p.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return p.testCommitProvider.ReadDir(ctx, path)
+}
+
+func TestListDirFlight(t *testing.T) {
+	p := &testListProvider{
+		testCommitProvider: testCommitProvider{
+			testProvider: testProvider{ents: []*testEntry{
+				{info: &types.Entry{Path: "README.md", Name: "README.md"}},
+				{info: &types.Entry{Path: "src", Name: "src", IsDir: true}},
+			}},
+			commits: map[string]*types.Commit{
+				"README.md": {SHA: "file"},
+			},
+		},
+		release: make(chan struct{}),
+	}
+	root := NewNode(&types.Repository{Commit: "abc"}, p, nil, &types.Config{Fs: &types.FilesystemConfig{
+		ModTime: types.ModTimeCommit,
+	}})
+
+	const count = 4
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// The nodes of the same directory, such as the ones before and
+			// after being forgotten by kernel.
+			node := newNode(&types.Entry{IsDir: true}, root.shared)
+			ents, err := node.listSubEntries(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if len(ents) != 2 || ents[0].Name != "README.md" {
+				t.Errorf("Unexpect entries %+v", ents)
+			}
+		}()
+	}
+
+	key := root.shared.current().flightKey("list", "")
+	for {
+		root.shared.flights.mu.Lock()
+		call := root.shared.flights.calls[key]
+		joined := call != nil && call.waiters == count
+		root.shared.flights.mu.Unlock()
+		if joined {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(p.release)
+	wg.Wait()
+
+	if n := p.readDirs.Load(); n != 1 {
+		t.Fatalf("Expect 1 readdir call, got %d", n)
+	}
+	if n := p.reads.Load(); n != 1 {
+		t.Fatalf("Expect commits to be read once, got %d", n)
+	}
+}
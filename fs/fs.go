@@ -2,10 +2,10 @@ package fs
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"sync/atomic"
 	"syscall"
-	"unsafe"
 
 	"github.com/fioncat/grfs/types"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
@@ -16,6 +16,10 @@ import (
 type Filesystem struct {
 	fuseServer *fuse.Server
 
+	// closer releases the background resources of the root node after the
+	// server stops, it is nil if the node has none.
+	closer io.Closer
+
 	stop     chan struct{}
 	stopFlag *uint32
 }
@@ -26,12 +30,21 @@ func Mount(node fusefs.InodeEmbedder, path string, cfg *types.Config) (*Filesyst
 		EntryTimeout:    &cfg.Fs.EntryTimeout,
 		NullPermissions: true,
 	})
+	if cfg.Fs.MetricsAddr != "" {
+		rawfs = &metricsFS{RawFileSystem: rawfs}
+	}
 
+	var options []string
+	if !cfg.Fs.ControlWritable {
+		// With writable control files, the repository nodes reject all writes
+		// with EROFS instead, see readOnlyNode.
+		options = append(options, "ro")
+	}
 	srv, err := fuse.NewServer(rawfs, path, &fuse.MountOptions{
 		AllowOther: cfg.Fs.AllowOthers,
 		FsName:     "grfs",
 		Name:       "grfs",
-		Options:    []string{"ro"},
+		Options:    options,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("Init fuse server: %w", err)
@@ -42,6 +55,7 @@ func Mount(node fusefs.InodeEmbedder, path string, cfg *types.Config) (*Filesyst
 		stop:       make(chan struct{}),
 		stopFlag:   new(uint32),
 	}
+	f.closer, _ = node.(io.Closer)
 	f.start()
 
 	return f, nil
@@ -51,6 +65,9 @@ func (fs *Filesystem) start() {
 	go func() {
 		logrus.Info("Start fuse.grfs server")
 		fs.fuseServer.Serve()
+		if fs.closer != nil {
+			fs.closer.Close()
+		}
 		atomic.StoreUint32(fs.stopFlag, 1)
 		close(fs.stop)
 	}()
@@ -96,16 +113,15 @@ func getEntryFileMode(ent *types.Entry) uint32 {
 	case ent.IsSymLink:
 		mode |= syscall.S_IFLNK
 	default:
+		if ent.Mode == types.GitModeExecutable {
+			mode = 0755
+		}
 		mode |= syscall.S_IFREG
 	}
 
 	return mode
 }
 
-func getEntryIno(ent *types.Entry) uint64 {
-	return uint64(uintptr(unsafe.Pointer(ent)))
-}
-
 func defaultStatfs(stat *fuse.StatfsOut) {
 	// http://man7.org/linux/man-pages/man2/statfs.2.html
 	stat.Blocks = 0 // dummy
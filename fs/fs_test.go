@@ -65,3 +65,23 @@ func TestMount(t *testing.T) {
 		t.Fatalf("Invalid file content %q", string(data))
 	}
 }
+
+func TestEntryFileMode(t *testing.T) {
+	testCases := []struct {
+		ent  *types.Entry
+		mode uint32
+	}{
+		{&types.Entry{IsDir: true, Mode: types.GitModeTree}, syscall.S_IFDIR | 0777},
+		{&types.Entry{Mode: types.GitModeFile}, syscall.S_IFREG | 0644},
+		{&types.Entry{Mode: types.GitModeExecutable}, syscall.S_IFREG | 0755},
+		{&types.Entry{IsSymLink: true, Mode: types.GitModeSymlink}, syscall.S_IFLNK | 0644},
+		{&types.Entry{}, syscall.S_IFREG | 0644},
+	}
+
+	for i, tc := range testCases {
+		mode := getEntryFileMode(tc.ent)
+		if mode != tc.mode {
+			t.Fatalf("Unexpect file mode %o, expect %o, index %d", mode, tc.mode, i)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package fs
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+)
+
+// rootIno is the inode number of root, which is reserved by go-fuse.
+const rootIno = 1
+
+// inodeTable assigns inode numbers computed from entry paths, so that the
+// same path always has the same inode number for a mount, even across
+// restarts. Hash collisions are resolved by hashing the path again with
+// increasing salts, the numbers tried for a path only depend on the path, so
+// a path never takes the number of another one by probing.
+type inodeTable struct {
+	inos  map[uint64]string
+	paths map[string]uint64
+
+	mu sync.Mutex
+}
+
+func newInodeTable() *inodeTable {
+	return &inodeTable{
+		inos:  make(map[uint64]string),
+		paths: make(map[string]uint64),
+	}
+}
+
+func (t *inodeTable) get(path string) uint64 {
+	if path == "" {
+		return rootIno
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if ino, ok := t.paths[path]; ok {
+		return ino
+	}
+
+	var ino uint64
+	for salt := uint64(0); ; salt++ {
+		ino = hashIno(path, salt)
+		if ino <= rootIno {
+			continue
+		}
+		if _, ok := t.inos[ino]; !ok {
+			break
+		}
+	}
+
+	t.inos[ino] = path
+	t.paths[path] = ino
+	return ino
+}
+
+// reset forgets the assigned numbers, it is called when the mounted revision
+// is replaced, so that the paths of old revisions are not kept forever. The
+// numbers of the same paths are computed again.
+func (t *inodeTable) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inos = make(map[uint64]string)
+	t.paths = make(map[string]uint64)
+}
+
+func hashIno(path string, salt uint64) uint64 {
+	hash := fnv.New64a()
+	if salt > 0 {
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], salt)
+		hash.Write(buf[:])
+	}
+	hash.Write([]byte(path))
+	return hash.Sum64()
+}
@@ -0,0 +1,47 @@
+package fs
+
+import "testing"
+
+func TestInodeTable(t *testing.T) {
+	table := newInodeTable()
+	if ino := table.get(""); ino != rootIno {
+		t.Fatalf("Unexpect root ino %d", ino)
+	}
+
+	paths := []string{"README.md", "src", "src/main.go", "src/pkg/util.go"}
+	inos := make(map[uint64]string, len(paths))
+	for _, path := range paths {
+		ino := table.get(path)
+		if ino <= rootIno {
+			t.Fatalf("Unexpect reserved ino %d for %q", ino, path)
+		}
+		if other, ok := inos[ino]; ok {
+			t.Fatalf("Ino %d is duplicated for %q and %q", ino, path, other)
+		}
+		inos[ino] = path
+	}
+
+	// The inode numbers should be the same in another table, like restarting
+	// the daemon.
+	table = newInodeTable()
+	for ino, path := range inos {
+		if got := table.get(path); got != ino {
+			t.Fatalf("Unexpect ino %d for %q after restarting, expect %d", got, path, ino)
+		}
+	}
+
+	// Simulate hash collision, the path should be hashed again with salt,
+	// no matter the neighbour numbers are taken or not.
+	table = newInodeTable()
+	ino := table.get("src/main.go")
+	table.reset()
+	table.inos[ino] = "collision"
+	table.inos[ino+1] = "taken"
+	expect := hashIno("src/main.go", 1)
+	if got := table.get("src/main.go"); got != expect {
+		t.Fatalf("Unexpect ino %d after collision, expect %d", got, expect)
+	}
+	if got := table.get("README.md"); got != hashIno("README.md", 0) {
+		t.Fatalf("Unexpect ino %d for README.md after collision", got)
+	}
+}
@@ -0,0 +1,103 @@
+package fs
+
+import (
+	"time"
+
+	"github.com/fioncat/grfs/metrics"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// metricsFS records the count and latency of FUSE operations handled by the
+// wrapped filesystem. Only the operations a read-only mount serves are
+// recorded, others are passed through directly.
+type metricsFS struct {
+	fuse.RawFileSystem
+}
+
+func observeOp(op string, start time.Time, code fuse.Status) {
+	metrics.ObserveFuseOp(op, start, code.Ok())
+}
+
+func (m *metricsFS) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	start := time.Now()
+	code := m.RawFileSystem.Lookup(cancel, header, name, out)
+	observeOp("lookup", start, code)
+	return code
+}
+
+func (m *metricsFS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	start := time.Now()
+	code := m.RawFileSystem.GetAttr(cancel, input, out)
+	observeOp("getattr", start, code)
+	return code
+}
+
+func (m *metricsFS) Readlink(cancel <-chan struct{}, header *fuse.InHeader) ([]byte, fuse.Status) {
+	start := time.Now()
+	out, code := m.RawFileSystem.Readlink(cancel, header)
+	observeOp("readlink", start, code)
+	return out, code
+}
+
+func (m *metricsFS) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string, dest []byte) (uint32, fuse.Status) {
+	start := time.Now()
+	sz, code := m.RawFileSystem.GetXAttr(cancel, header, attr, dest)
+	observeOp("getxattr", start, code)
+	return sz, code
+}
+
+func (m *metricsFS) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (uint32, fuse.Status) {
+	start := time.Now()
+	sz, code := m.RawFileSystem.ListXAttr(cancel, header, dest)
+	observeOp("listxattr", start, code)
+	return sz, code
+}
+
+func (m *metricsFS) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	start := time.Now()
+	code := m.RawFileSystem.Open(cancel, input, out)
+	observeOp("open", start, code)
+	return code
+}
+
+func (m *metricsFS) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+	start := time.Now()
+	result, code := m.RawFileSystem.Read(cancel, input, buf)
+	observeOp("read", start, code)
+	return result, code
+}
+
+func (m *metricsFS) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	start := time.Now()
+	written, code := m.RawFileSystem.Write(cancel, input, data)
+	observeOp("write", start, code)
+	return written, code
+}
+
+func (m *metricsFS) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	start := time.Now()
+	code := m.RawFileSystem.OpenDir(cancel, input, out)
+	observeOp("opendir", start, code)
+	return code
+}
+
+func (m *metricsFS) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	start := time.Now()
+	code := m.RawFileSystem.ReadDir(cancel, input, out)
+	observeOp("readdir", start, code)
+	return code
+}
+
+func (m *metricsFS) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	start := time.Now()
+	code := m.RawFileSystem.ReadDirPlus(cancel, input, out)
+	observeOp("readdirplus", start, code)
+	return code
+}
+
+func (m *metricsFS) StatFs(cancel <-chan struct{}, header *fuse.InHeader, out *fuse.StatfsOut) fuse.Status {
+	start := time.Now()
+	code := m.RawFileSystem.StatFs(cancel, header, out)
+	observeOp("statfs", start, code)
+	return code
+}
@@ -2,17 +2,24 @@ package fs
 
 import (
 	"bytes"
+	"container/list"
 	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"os/user"
+	"path"
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/dustin/go-humanize"
+	"github.com/fioncat/grfs/metrics"
+	"github.com/fioncat/grfs/provider"
 	"github.com/fioncat/grfs/types"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -20,6 +27,8 @@ import (
 )
 
 var (
+	_ = (types.DaemonController)((*Node)(nil))
+
 	_ = (fusefs.InodeEmbedder)((*Node)(nil))
 
 	_ = (fusefs.NodeReaddirer)((*Node)(nil))
@@ -32,35 +41,170 @@ var (
 	_ = (fusefs.NodeGetxattrer)((*Node)(nil))
 	_ = (fusefs.NodeListxattrer)((*Node)(nil))
 
+	_ = (fusefs.NodeSetattrer)((*Node)(nil))
+	_ = (fusefs.NodeSetxattrer)((*Node)(nil))
+	_ = (fusefs.NodeRemovexattrer)((*Node)(nil))
+	_ = (fusefs.NodeMkdirer)((*Node)(nil))
+	_ = (fusefs.NodeMknoder)((*Node)(nil))
+	_ = (fusefs.NodeUnlinker)((*Node)(nil))
+	_ = (fusefs.NodeRmdirer)((*Node)(nil))
+	_ = (fusefs.NodeRenamer)((*Node)(nil))
+	_ = (fusefs.NodeSymlinker)((*Node)(nil))
+	_ = (fusefs.NodeLinker)((*Node)(nil))
+
 	_ = (fusefs.NodeOpener)((*Node)(nil))
+	_ = (fusefs.NodeReleaser)((*Node)(nil))
 	_ = (fusefs.FileReader)((*Node)(nil))
 )
 
+// nodeShared holds the states shared by all nodes of a mounted repository.
+// Submodules have their own repository states, but share the global ones.
+type nodeShared struct {
+	// state is replaced as a whole when refreshing or checking out, use
+	// current to get it.
+	state atomic.Pointer[repoState]
+
+	// prefix is the path of the repository in the mount, it is empty for the
+	// root repository, and is the submodule path for submodules.
+	prefix string
+
+	cfg          *types.FilesystemConfig
+	cache        types.BlobCache
+	inodes       *inodeTable
+	chunks       *chunkCache
+	buffers      *bufferPool
+	loadProvider func(repo *types.Repository) (types.Provider, error)
+
+	stats  *fsStats
+	errors *errorLog
+	// flights coalesces the concurrent provider calls across the daemon.
+	flights *flightGroup
+	// prefetcher is nil if prefetching is disabled.
+	prefetcher *prefetcher
+	// gen is increased when refreshing, the directory caches loaded in older
+	// generations are expired.
+	gen *atomic.Uint64
+
+	// saveRepo saves the repository checked out by the control file, it is
+	// only set for the mount root, see SetRepoSaver.
+	saveRepo func(repo *types.Repository) error
+
+	checkoutMu sync.Mutex
+}
+
+// repoState is the mounted revision of a repository, with the provider and
+// indexes reading it. It is never modified after created, so the readers see
+// a consistent view during checking out.
+type repoState struct {
+	// id is unique for each state, to tell the provider calls on different
+	// states apart.
+	id uint64
+
+	repo     *types.Repository
+	provider types.Provider
+
+	tree       *treeIndex
+	commits    *commitIndex
+	submodules *submoduleIndex
+}
+
 type Node struct {
 	fusefs.Inode
+	readOnlyNode
 
-	provider types.Provider
+	shared *nodeShared
 
 	entry *types.Entry
 
 	logger *logrus.Entry
 
-	createTime time.Time
-
 	subDirEnts []fuse.DirEntry
 	subEnts    []*types.Entry
 	subCache   bool
+	subTime    time.Time
+	subGen     uint64
 	subMu      sync.Mutex
 
-	reader        *bytes.Reader
+	reader *bytes.Reader
+	// openCount is the number of file handles reading the buffer, ranged
+	// reads have their own handles, see rangeFile.
+	openCount     int
 	readContentMu sync.Mutex
+
+	// bufferElem is the position of this node in the buffer pool, guarded
+	// by the pool lock.
+	bufferElem *list.Element
+
+	// linkName is the symlink target read on demand, see types.LinkReader.
+	linkName string
+	linkMu   sync.Mutex
 }
 
-func NewNode(provider types.Provider) *Node {
-	return newNode(&types.Entry{IsDir: true}, provider)
+func NewNode(repo *types.Repository, prov types.Provider, cache types.BlobCache, cfg *types.Config) *Node {
+	shared := &nodeShared{
+		cfg:     cfg.Fs,
+		cache:   cache,
+		inodes:  newInodeTable(),
+		chunks:  newChunkCache(int64(cfg.Fs.ChunkCacheSize)),
+		buffers: newBufferPool(int64(cfg.Fs.MemoryLimit)),
+		loadProvider: func(repo *types.Repository) (types.Provider, error) {
+			return provider.Load(repo, cfg)
+		},
+		stats:      newFsStats(),
+		errors:     new(errorLog),
+		flights:    newFlightGroup(),
+		prefetcher: newPrefetcher(cfg.Fs),
+		gen:        new(atomic.Uint64),
+	}
+	return newNode(&types.Entry{IsDir: true}, shared.withRepo(repo, prov, ""))
+}
+
+// withRepo returns the shared states for a repository mounted on prefix.
+func (s *nodeShared) withRepo(repo *types.Repository, prov types.Provider, prefix string) *nodeShared {
+	shared := &nodeShared{
+		prefix: prefix,
+
+		cfg:          s.cfg,
+		cache:        s.cache,
+		inodes:       s.inodes,
+		chunks:       s.chunks,
+		buffers:      s.buffers,
+		loadProvider: s.loadProvider,
+		stats:        s.stats,
+		errors:       s.errors,
+		flights:      s.flights,
+		prefetcher:   s.prefetcher,
+		gen:          s.gen,
+	}
+	shared.state.Store(shared.newState(repo, prov))
+	return shared
+}
+
+var repoStateID atomic.Uint64
+
+func (s *nodeShared) newState(repo *types.Repository, prov types.Provider) *repoState {
+	return &repoState{
+		id:       repoStateID.Add(1),
+		repo:     repo,
+		provider: prov,
+
+		tree:       newTreeIndex(prov, repo, s.cfg),
+		commits:    newCommitIndex(prov, repo, s.cfg),
+		submodules: newSubmoduleIndex(prov),
+	}
+}
+
+// current returns the state of the mounted revision. The callers should use
+// the same state during an operation.
+func (s *nodeShared) current() *repoState {
+	return s.state.Load()
+}
+
+func (s *nodeShared) getIno(ent *types.Entry) uint64 {
+	return s.inodes.get(path.Join(s.prefix, ent.Path))
 }
 
-func newNode(ent *types.Entry, provider types.Provider) *Node {
+func newNode(ent *types.Entry, shared *nodeShared) *Node {
 	logger := logrus.WithFields(logrus.Fields{
 		"Path":      ent.Path,
 		"IsDir":     ent.IsDir,
@@ -70,134 +214,769 @@ func newNode(ent *types.Entry, provider types.Provider) *Node {
 	})
 
 	return &Node{
-		provider: provider,
-		entry:    ent,
-
-		createTime: time.Now(),
+		shared: shared,
+		entry:  ent,
 
 		logger: logger,
 	}
 }
 
+// isRoot reports whether the node is the mount root, rather than the root of
+// a submodule.
+func (n *Node) isRoot() bool {
+	return n.entry.Path == "" && n.shared.prefix == ""
+}
+
+// logError logs the error and records it for the control directory.
+func (n *Node) logError(msg string, err error) {
+	n.logger.Errorf("%s error: %v", msg, err)
+	n.shared.stats.errors.Add(1)
+	n.shared.errors.add(path.Join(n.shared.prefix, n.entry.Path), fmt.Errorf("%s: %w", msg, err))
+}
+
+// withTimeout bounds the provider requests of a FUSE operation, zero means
+// no timeout. The FUSE context is done when the request is interrupted.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// providerErrno returns the errno for the failed provider call, decided by
+// the typed errors of providers.
+func providerErrno(err error) syscall.Errno {
+	switch {
+	case errors.Is(err, context.Canceled):
+		// The request was interrupted, such as the process being killed.
+		return syscall.EINTR
+	case errors.Is(err, context.DeadlineExceeded):
+		return syscall.ETIMEDOUT
+	case errors.Is(err, types.ErrNotFound):
+		return syscall.ENOENT
+	case errors.Is(err, types.ErrUnauthorized), errors.Is(err, types.ErrForbidden):
+		return syscall.EACCES
+	case errors.Is(err, types.ErrRateLimited):
+		// The callers can retry after the rate limit is reset.
+		return syscall.EAGAIN
+	case errors.Is(err, types.ErrTooLarge):
+		return syscall.EFBIG
+	case errors.Is(err, types.ErrTimeout):
+		return syscall.ETIMEDOUT
+	}
+	return syscall.EIO
+}
+
 func (n *Node) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
+	ctx, cancel := withTimeout(ctx, n.shared.cfg.ReadDirTimeout)
+	defer cancel()
+
 	ents, err := n.listSubEntries(ctx)
 	if err != nil {
-		n.logger.Errorf("List sub entries error: %v", err)
-		return nil, syscall.EIO
+		n.logError("List sub entries", err)
+		return nil, providerErrno(err)
+	}
+	if n.isRoot() {
+		ents = append(ents[:len(ents):len(ents)], n.controlDirEntry())
 	}
 
 	return fusefs.NewListDirStream(ents), 0
 }
 
+// readDir reads the sub entries from provider, the concurrent reads of the
+// same directory are coalesced.
+func (n *Node) readDir(ctx context.Context, state *repoState) ([]*types.Entry, error) {
+	key := state.flightKey("readdir", n.entry.Path)
+	if ents, ok := n.shared.prefetcher.take(key); ok {
+		return ents, nil
+	}
+	return n.fetchDir(ctx, state, key)
+}
+
+func (n *Node) fetchDir(ctx context.Context, state *repoState, key string) ([]*types.Entry, error) {
+	val, err := n.shared.flights.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		n.shared.stats.readDirs.Add(1)
+		return state.provider.ReadDir(ctx, n.entry.Path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Return a copy, the caller sorts it and replaces the submodule entries.
+	ents := val.([]*types.Entry)
+	return append([]*types.Entry(nil), ents...), nil
+}
+
 func (n *Node) listSubEntries(ctx context.Context) ([]fuse.DirEntry, error) {
 	n.subMu.Lock()
-	if n.subCache {
+	if n.subCache && !n.subExpired() {
 		ents := n.subDirEnts
 		n.subMu.Unlock()
 		return ents, nil
 	}
+	// Load the gen before the state, so that the entries of an old state are
+	// never cached as the current gen.
+	gen := n.shared.gen.Load()
 	n.subMu.Unlock()
+	state := n.shared.current()
 
 	start := time.Now()
-	ents, err := n.provider.ReadDir(context.Background(), n.entry.Path)
+	ents, err := n.listDir(ctx, state)
 	if err != nil {
-		return nil, fmt.Errorf("Provider readdir: %w", err)
+		return nil, err
 	}
-	sort.Slice(ents, func(i, j int) bool {
-		return ents[i].Name < ents[j].Name
-	})
 	n.logger.Debugf("Read dir done, with %d entries, took %v", len(ents), time.Since(start))
 
-	dirEnts := make([]fuse.DirEntry, len(ents))
-	for i, gitEnt := range ents {
-		dirEnts[i] = fuse.DirEntry{
+	dirEnts := make([]fuse.DirEntry, 0, len(ents))
+	for _, gitEnt := range ents {
+		if n.isRoot() && gitEnt.Name == n.shared.cfg.ControlDir {
+			// The control directory takes the name in the root, the entry
+			// cannot be looked up, see Lookup.
+			n.logger.Warnf("Entry %q clashes with the control directory, hide it", gitEnt.Name)
+			continue
+		}
+		dirEnts = append(dirEnts, fuse.DirEntry{
 			Mode: getEntryFileMode(gitEnt),
 			Name: gitEnt.Name,
-			Ino:  getEntryIno(gitEnt),
-		}
+			Ino:  n.shared.getIno(gitEnt),
+		})
 	}
 
 	n.subMu.Lock()
-	defer n.subMu.Unlock()
+	oldEnts, refresh := n.subEnts, n.subCache
 	n.subDirEnts, n.subCache = dirEnts, true // cache it
 	n.subEnts = ents
+	n.subTime, n.subGen = time.Now(), gen
+	n.subMu.Unlock()
+
+	if refresh {
+		n.notifySubChanges(oldEnts, ents)
+	}
 
 	return dirEnts, nil
 }
 
+// listDir reads the sorted sub entries, with their submodules and commits
+// loaded. The concurrent listings of the same directory are coalesced as a
+// whole, the returned entries are shared and should not be modified.
+func (n *Node) listDir(ctx context.Context, state *repoState) ([]*types.Entry, error) {
+	if n.entry.Submodule != nil {
+		// This is a submodule which can never be loaded, show it as an empty
+		// directory. See newSubmoduleNode.
+		return nil, nil
+	}
+
+	key := state.flightKey("list", n.entry.Path)
+	val, err := n.shared.flights.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		ents, ok := state.tree.readDir(ctx, n.entry.Path)
+		if !ok {
+			// The listing might stop waiting for the tree since interrupted.
+			err := ctx.Err()
+			if err != nil {
+				return nil, err
+			}
+			ents, err = n.readDir(ctx, state)
+			if err != nil {
+				return nil, fmt.Errorf("Provider readdir: %w", err)
+			}
+		}
+		state.submodules.fill(ctx, ents)
+		sort.Slice(ents, func(i, j int) bool {
+			return ents[i].Name < ents[j].Name
+		})
+
+		state.commits.loadDir(ents)
+		// The submodules might be incomplete if the request was interrupted,
+		// do not share them.
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		n.shared.prefetcher.schedule(n.shared, state, ents, n.shared.cfg.PrefetchDepth)
+		return ents, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.([]*types.Entry), nil
+}
+
+func (n *Node) subExpired() bool {
+	if n.subGen != n.shared.gen.Load() {
+		// Refreshed by the control directory.
+		return true
+	}
+	if n.shared.current().repo.IsPinned() {
+		// The content of a commit never changes.
+		return false
+	}
+	ttl := n.shared.cfg.DirCacheTTL
+	if ttl <= 0 {
+		return false
+	}
+	return time.Since(n.subTime) > ttl
+}
+
+// notifySubChanges compares the refreshed sub entries with the old ones. The
+// inodes of removed or changed entries are dropped, and the kernel is told to
+// forget its cached dentries, so that the changes upstream can be seen.
+func (n *Node) notifySubChanges(oldEnts, newEnts []*types.Entry) {
+	oldMap := make(map[string]*types.Entry, len(oldEnts))
+	for _, ent := range oldEnts {
+		oldMap[ent.Name] = ent
+	}
+
+	var changed []string
+	for _, ent := range newEnts {
+		oldEnt, ok := oldMap[ent.Name]
+		delete(oldMap, ent.Name)
+		if ok && !isEntryChanged(oldEnt, ent) {
+			continue
+		}
+		// The entry was added or changed.
+		changed = append(changed, ent.Name)
+	}
+	for name := range oldMap {
+		// The entry was removed.
+		changed = append(changed, name)
+	}
+	if len(changed) == 0 {
+		return
+	}
+	n.logger.Debugf("Sub entries changed upstream: %v", changed)
+
+	var children []*fusefs.Inode
+	for _, name := range changed {
+		if child := n.GetChild(name); child != nil {
+			children = append(children, child)
+			n.RmChild(name)
+		}
+	}
+
+	// The kernel might hold the directory lock while we are handling its
+	// operation, notify it asynchronously to avoid deadlock.
+	go func() {
+		for _, child := range children {
+			child.NotifyContent(0, 0)
+		}
+		for _, name := range changed {
+			errno := n.NotifyEntry(name)
+			if errno != 0 {
+				n.logger.Debugf("Notify entry %q error: %v", name, errno)
+			}
+		}
+	}()
+}
+
+func isEntryChanged(oldEnt, newEnt *types.Entry) bool {
+	if oldEnt.SHA != "" || newEnt.SHA != "" {
+		return oldEnt.SHA != newEnt.SHA
+	}
+	return getEntryFileMode(oldEnt) != getEntryFileMode(newEnt) ||
+		oldEnt.Size != newEnt.Size ||
+		oldEnt.LinkName != newEnt.LinkName
+}
+
+func (n *Node) findSubEntry(name string) (*types.Entry, bool) {
+	n.subMu.Lock()
+	defer n.subMu.Unlock()
+	if !n.subCache {
+		return nil, false
+	}
+	for _, ent := range n.subEnts {
+		if ent.Name == name {
+			return ent, true
+		}
+	}
+	return nil, true
+}
+
 func (n *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	if n.isRoot() && name == n.shared.cfg.ControlDir {
+		return n.lookupControlDir(ctx, &n.Inode, n, out), 0
+	}
+
+	ctx, cancel := withTimeout(ctx, n.shared.cfg.ReadDirTimeout)
+	defer cancel()
+
+	// Make sure the sub entries are fresh first, the expired children will be
+	// removed.
+	_, err := n.listSubEntries(ctx)
+	if err != nil {
+		n.logError("Ensure sub entries cache ready", err)
+		return nil, providerErrno(err)
+	}
+
 	// lookup on memory nodes
 	if cn := n.GetChild(name); cn != nil {
 		switch subNode := cn.Operations().(type) {
 		case *Node:
-			subNode.entryToAttr(subNode.entry, &out.Attr)
+			subNode.entryToAttr(ctx, subNode.entry, &out.Attr)
 		default:
 			return nil, syscall.EIO
 		}
 		return cn, 0
 	}
 
-	_, err := n.listSubEntries(ctx)
-	if err != nil {
-		n.logger.Errorf("Ensure sub entries cache ready: %v", err)
-		return nil, syscall.EIO
-	}
-	if !n.subCache {
+	found, ready := n.findSubEntry(name)
+	if !ready {
 		n.logger.Error("Unexpect error, the sub entries cache should be ready after ensuring")
 		return nil, syscall.EIO
 	}
-
-	var found *types.Entry
-	for _, ent := range n.subEnts {
-		if ent.Name == name {
-			found = ent
-			break
-		}
-	}
 	if found == nil {
 		return nil, syscall.ENOENT
 	}
 
-	subNode := newNode(found, n.provider)
-	subAttr := subNode.entryToAttr(found, &out.Attr)
+	var subNode *Node
+	if found.Submodule != nil {
+		var err error
+		subNode, err = n.newSubmoduleNode(ctx, found)
+		if err != nil {
+			n.logError(fmt.Sprintf("Load submodule %q", name), err)
+			return nil, providerErrno(err)
+		}
+	} else {
+		subNode = newNode(found, n.shared)
+	}
+	subAttr := subNode.entryToAttr(ctx, subNode.entry, &out.Attr)
 	return n.NewInode(ctx, subNode, subAttr), 0
 }
 
 func (n *Node) Open(ctx context.Context, flags uint32) (fh fusefs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+
+	ctx, cancel := withTimeout(ctx, n.shared.cfg.ReadFileTimeout)
+	defer cancel()
+
+	state := n.shared.current()
+	if rangeReader := n.getRangeReader(state); rangeReader != nil {
+		n.logger.Debugf("File is too large, use ranged reads")
+		return &rangeFile{node: n, state: state, reader: rangeReader}, fuse.FOPEN_KEEP_CACHE, 0
+	}
+
+	n.readContentMu.Lock()
+	reader, loaded, err := n.loadReader(ctx)
+	if err != nil {
+		n.readContentMu.Unlock()
+		n.logError("Read content", err)
+		return nil, 0, providerErrno(err)
+	}
+	n.openCount++
+	n.readContentMu.Unlock()
+
+	n.trackReader(reader, loaded)
+	return n, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+func (n *Node) Release(ctx context.Context, f fusefs.FileHandle) syscall.Errno {
+	if _, ok := f.(*rangeFile); ok {
+		// The ranged reads hold no buffer, drop the handle.
+		return 0
+	}
+
+	n.readContentMu.Lock()
+	defer n.readContentMu.Unlock()
+
+	if n.openCount > 0 {
+		n.openCount--
+	}
+	if n.openCount == 0 && n.reader != nil {
+		// The last file handle is released, no one needs the buffer anymore.
+		// The kernel still keeps its page cache.
+		n.reader = nil
+		n.shared.buffers.remove(n)
+	}
+	return 0
+}
+
+// readOnlyNode rejects all the modifications, it is embedded by the nodes of
+// repositories. The mount is not read-only with writable control files, so
+// the nodes must reject the writes themselves.
+type readOnlyNode struct{}
+
+var (
+	_ = (fusefs.NodeCreater)((*readOnlyNode)(nil))
+	_ = (fusefs.NodeSetattrer)((*readOnlyNode)(nil))
+	_ = (fusefs.NodeSetxattrer)((*readOnlyNode)(nil))
+	_ = (fusefs.NodeRemovexattrer)((*readOnlyNode)(nil))
+	_ = (fusefs.NodeMkdirer)((*readOnlyNode)(nil))
+	_ = (fusefs.NodeMknoder)((*readOnlyNode)(nil))
+	_ = (fusefs.NodeUnlinker)((*readOnlyNode)(nil))
+	_ = (fusefs.NodeRmdirer)((*readOnlyNode)(nil))
+	_ = (fusefs.NodeRenamer)((*readOnlyNode)(nil))
+	_ = (fusefs.NodeSymlinker)((*readOnlyNode)(nil))
+	_ = (fusefs.NodeLinker)((*readOnlyNode)(nil))
+)
+
+func (readOnlyNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fusefs.Inode, fusefs.FileHandle, uint32, syscall.Errno) {
+	return nil, nil, 0, syscall.EROFS
+}
+
+func (readOnlyNode) Setattr(ctx context.Context, f fusefs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	return syscall.EROFS
+}
+
+func (readOnlyNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	return syscall.EROFS
+}
+
+func (readOnlyNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	return syscall.EROFS
+}
+
+func (readOnlyNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	return nil, syscall.EROFS
+}
+
+func (readOnlyNode) Mknod(ctx context.Context, name string, mode uint32, dev uint32, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	return nil, syscall.EROFS
+}
+
+func (readOnlyNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	return syscall.EROFS
+}
+
+func (readOnlyNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	return syscall.EROFS
+}
+
+func (readOnlyNode) Rename(ctx context.Context, name string, newParent fusefs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	return syscall.EROFS
+}
+
+func (readOnlyNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	return nil, syscall.EROFS
+}
+
+func (readOnlyNode) Link(ctx context.Context, target fusefs.InodeEmbedder, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	return nil, syscall.EROFS
+}
+
+// loadReader makes sure the content buffer is ready, it should be called
+// with readContentMu held. If the buffer was empty or evicted, the content
+// will be read again, and loaded is true.
+func (n *Node) loadReader(ctx context.Context) (reader *bytes.Reader, loaded bool, err error) {
+	if n.reader != nil {
+		return n.reader, false, nil
+	}
+
+	// The content of this file entry is empty, read from cache or provider
+	data, err := n.readContent(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	n.reader = bytes.NewReader(data)
+	return n.reader, true, nil
+}
+
+// trackReader reports the buffer usage to the pool, it must be called without
+// readContentMu held, since the pool might evict other nodes.
+func (n *Node) trackReader(reader *bytes.Reader, loaded bool) {
+	if loaded {
+		n.shared.buffers.add(n, reader.Size())
+		return
+	}
+	n.shared.buffers.touch(n)
+}
+
+func (n *Node) dropReader() {
 	n.readContentMu.Lock()
 	defer n.readContentMu.Unlock()
+	n.reader = nil
+}
+
+// readContent reads the file content, the concurrent reads of the same file
+// are coalesced, even from different nodes.
+func (n *Node) readContent(ctx context.Context) ([]byte, error) {
+	state := n.shared.current()
+	key := state.flightKey("read", n.entry.Path)
+	val, err := n.shared.flights.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		return n.fetchContent(ctx, state)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.([]byte), nil
+}
 
-	if n.reader == nil {
-		// The content of this file entry is empty, read from provider
-		start := time.Now()
-		data, err := n.provider.ReadFile(context.Background(), n.entry.Path)
+func (n *Node) fetchContent(ctx context.Context, state *repoState) ([]byte, error) {
+	var cacheKey string
+	if n.shared.cache != nil {
+		cacheKey = types.BlobCacheKey(state.repo, n.entry)
+	}
+
+	if cacheKey != "" {
+		data, ok, err := n.shared.cache.Get(cacheKey)
 		if err != nil {
-			n.logger.Errorf("Read content from provider error: %v", err)
-			return nil, 0, syscall.EIO
+			n.logger.Warnf("Read content from blob cache error: %v", err)
+		}
+		if ok {
+			n.shared.stats.cacheHits.Add(1)
+			metrics.ObserveCache("blob", true)
+			n.logger.Debugf("Read file from blob cache, size %s", humanize.Bytes(uint64(len(data))))
+			return data, nil
 		}
-		n.logger.Debugf("Download file done, size %s, took %v",
-			humanize.Bytes(uint64(n.entry.Size)), time.Since(start))
-		n.reader = bytes.NewReader(data)
 	}
 
-	return n, fuse.FOPEN_KEEP_CACHE, 0
+	if cacheKey != "" {
+		n.shared.stats.cacheMisses.Add(1)
+		metrics.ObserveCache("blob", false)
+	}
+	return n.downloadContent(ctx, state, cacheKey)
+}
+
+// downloadContent reads the file content from provider, and puts it to the
+// blob cache if cacheKey is not empty.
+func (n *Node) downloadContent(ctx context.Context, state *repoState, cacheKey string) ([]byte, error) {
+	start := time.Now()
+	n.shared.stats.readFiles.Add(1)
+	data, err := state.provider.ReadFile(ctx, n.entry.Path)
+	if err != nil {
+		return nil, fmt.Errorf("Provider read file: %w", err)
+	}
+	n.shared.stats.downloadBytes.Add(int64(len(data)))
+	metrics.AddDownloadBytes(len(data))
+	n.logger.Debugf("Download file done, size %s, took %v",
+		humanize.Bytes(uint64(len(data))), time.Since(start))
+
+	if cacheKey != "" {
+		err = n.shared.cache.Put(cacheKey, data)
+		if err != nil {
+			n.logger.Warnf("Write content to blob cache error: %v", err)
+		}
+	}
+
+	return data, nil
+}
+
+// rangeFile is the file handle of a large file read by chunks. The provider
+// is bound to the handle when opening, so that the chunks read after
+// checking out are still from the opened revision, and cached by its key.
+type rangeFile struct {
+	node   *Node
+	state  *repoState
+	reader types.RangeReader
+}
+
+var _ = (fusefs.FileReader)((*rangeFile)(nil))
+
+func (f *rangeFile) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	n := f.node
+	ctx, cancel := withTimeout(ctx, n.shared.cfg.ReadFileTimeout)
+	defer cancel()
+
+	readn, err := f.readRange(ctx, dest, off)
+	if err != nil {
+		n.logError("Read range", err)
+		return nil, providerErrno(err)
+	}
+	return fuse.ReadResultData(dest[:readn]), 0
+}
+
+func (n *Node) getRangeReader(state *repoState) types.RangeReader {
+	cfg := n.shared.cfg
+	if cfg.ChunkSize <= 0 || cfg.RangeReadThreshold <= 0 {
+		return nil
+	}
+	if n.entry.Size < int64(cfg.RangeReadThreshold) {
+		return nil
+	}
+
+	rangeReader, _ := state.provider.(types.RangeReader)
+	return rangeReader
+}
+
+func (f *rangeFile) readRange(ctx context.Context, dest []byte, off int64) (int, error) {
+	n := f.node
+	chunkSize := int64(n.shared.cfg.ChunkSize)
+	end := off + int64(len(dest))
+	if end > n.entry.Size {
+		end = n.entry.Size
+	}
+
+	var readn int64
+	for cur := off; cur < end; {
+		index := cur / chunkSize
+		chunk, err := f.readChunk(ctx, index, chunkSize)
+		if err != nil {
+			return 0, err
+		}
+
+		chunkOff := cur - index*chunkSize
+		if chunkOff >= int64(len(chunk)) {
+			// The file is shorter than the entry size, reach EOF
+			break
+		}
+		copied := int64(copy(dest[readn:end-off], chunk[chunkOff:]))
+		readn += copied
+		cur += copied
+	}
+
+	return int(readn), nil
+}
+
+func (f *rangeFile) readChunk(ctx context.Context, index, chunkSize int64) ([]byte, error) {
+	n, state := f.node, f.state
+	blobKey := types.BlobCacheKey(state.repo, n.entry)
+	if blobKey == "" {
+		// The chunks are shared by all the repositories and revisions, scope
+		// the path by the state.
+		blobKey = state.flightKey("chunk", n.entry.Path)
+	}
+	key := chunkKey{blob: blobKey, index: index}
+
+	if data, ok := n.shared.chunks.get(key); ok {
+		metrics.ObserveCache("chunk", true)
+		return data, nil
+	}
+	metrics.ObserveCache("chunk", false)
+
+	flightKey := state.flightKey("chunk", fmt.Sprintf("%s:%d", n.entry.Path, index))
+	val, err := n.shared.flights.do(ctx, flightKey, func(ctx context.Context) (interface{}, error) {
+		return f.fetchChunk(ctx, key, chunkSize)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.([]byte), nil
+}
+
+func (f *rangeFile) fetchChunk(ctx context.Context, key chunkKey, chunkSize int64) ([]byte, error) {
+	n := f.node
+	start := time.Now()
+	n.shared.stats.readRanges.Add(1)
+	data, err := f.reader.ReadFileRange(ctx, n.entry.Path, key.index*chunkSize, chunkSize)
+	if err != nil {
+		return nil, fmt.Errorf("Provider read file range: %w", err)
+	}
+	n.shared.stats.downloadBytes.Add(int64(len(data)))
+	metrics.AddDownloadBytes(len(data))
+	n.logger.Debugf("Download chunk %d done, size %s, took %v", key.index,
+		humanize.Bytes(uint64(len(data))), time.Since(start))
+
+	n.shared.chunks.put(key, data)
+	return data, nil
 }
 
 func (n *Node) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
-	n.entryToAttr(n.entry, &out.Attr)
+	// The ref commit might be read for the modification time.
+	ctx, cancel := withTimeout(ctx, n.shared.cfg.ReadDirTimeout)
+	defer cancel()
+	n.entryToAttr(ctx, n.entry, &out.Attr)
 	return 0
 }
 
 func (n *Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	// The last commit might be read on demand.
+	ctx, cancel := withTimeout(ctx, n.shared.cfg.ReadDirTimeout)
+	defer cancel()
+	for _, xattr := range n.getXattrs(ctx) {
+		if xattr.name != attr {
+			continue
+		}
+		if len(dest) < len(xattr.value) {
+			return uint32(len(xattr.value)), syscall.ERANGE
+		}
+		return uint32(copy(dest, xattr.value)), 0
+	}
 	return 0, syscall.ENODATA
 }
 
 func (n *Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
-	return 0, 0
+	ctx, cancel := withTimeout(ctx, n.shared.cfg.ReadDirTimeout)
+	defer cancel()
+	var names []byte
+	for _, xattr := range n.getXattrs(ctx) {
+		names = append(names, xattr.name...)
+		names = append(names, 0)
+	}
+	if len(dest) < len(names) {
+		return uint32(len(names)), syscall.ERANGE
+	}
+	return uint32(copy(dest, names)), 0
+}
+
+type nodeXattr struct {
+	name  string
+	value string
+}
+
+func (n *Node) getXattrs(ctx context.Context) []nodeXattr {
+	var xattrs []nodeXattr
+	add := func(name, value string) {
+		if value != "" {
+			xattrs = append(xattrs, nodeXattr{name: "user.grfs." + name, value: value})
+		}
+	}
+
+	add("weburl", n.entry.WebUrl)
+	add("sha", n.entry.SHA)
+	if n.entry.Mode != 0 {
+		add("mode", fmt.Sprintf("%06o", n.entry.Mode))
+	}
+	state := n.shared.current()
+	add("ref", state.repo.Ref)
+	add("commit", state.repo.Commit)
+
+	// The other attributes are still returned if the last commit cannot be
+	// read in time.
+	if commit := state.commits.getLastCommit(ctx, n.entry.Path); commit != nil {
+		add("lastcommit.sha", commit.SHA)
+		add("lastcommit.author", commit.Author)
+		if !commit.Time.IsZero() {
+			add("lastcommit.date", commit.Time.Format(time.RFC3339))
+		}
+	}
+
+	if submodule := n.entry.Submodule; submodule != nil {
+		add("submodule.url", submodule.URL)
+		add("submodule.commit", submodule.Commit)
+	}
+	return xattrs
 }
 
 func (n *Node) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
-	return []byte(n.entry.LinkName), 0
+	ctx, cancel := withTimeout(ctx, n.shared.cfg.ReadFileTimeout)
+	defer cancel()
+
+	target, err := n.readLink(ctx)
+	if err != nil {
+		n.logError("Read link", err)
+		return nil, providerErrno(err)
+	}
+	return []byte(target), 0
+}
+
+func (n *Node) readLink(ctx context.Context) (string, error) {
+	if n.entry.LinkName != "" {
+		return n.entry.LinkName, nil
+	}
+	state := n.shared.current()
+	reader, ok := state.provider.(types.LinkReader)
+	if !ok {
+		return "", nil
+	}
+
+	n.linkMu.Lock()
+	target := n.linkName
+	n.linkMu.Unlock()
+	if target != "" {
+		return target, nil
+	}
+
+	key := state.flightKey("readlink", n.entry.Path)
+	val, err := n.shared.flights.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		return reader.ReadLink(ctx, n.entry)
+	})
+	if err != nil {
+		return "", err
+	}
+	target = val.(string)
+
+	n.linkMu.Lock()
+	n.linkName = target
+	n.linkMu.Unlock()
+	return target, nil
 }
 
 func (n *Node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
@@ -206,27 +985,40 @@ func (n *Node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
 }
 
 func (n *Node) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
-	readn, err := n.reader.ReadAt(dest, off)
+	ctx, cancel := withTimeout(ctx, n.shared.cfg.ReadFileTimeout)
+	defer cancel()
+
+	n.readContentMu.Lock()
+	reader, loaded, err := n.loadReader(ctx)
+	n.readContentMu.Unlock()
+	if err != nil {
+		n.logError("Read evicted content", err)
+		return nil, providerErrno(err)
+	}
+	n.trackReader(reader, loaded)
+
+	readn, err := reader.ReadAt(dest, off)
 	if err != nil && err != io.EOF {
-		n.logger.Errorf("Read from content buffer error: %v", err)
+		n.logError("Read from content buffer", err)
 		return nil, syscall.EIO
 	}
 	return fuse.ReadResultData(dest[:readn]), 0
 }
 
-func (n *Node) entryToAttr(ent *types.Entry, out *fuse.Attr) fusefs.StableAttr {
-	ino := getEntryIno(ent)
+func (n *Node) entryToAttr(ctx context.Context, ent *types.Entry, out *fuse.Attr) fusefs.StableAttr {
+	ino := n.shared.getIno(ent)
 
 	out.Ino = ino
 	out.Size = uint64(ent.Size)
-	if ent.IsSymLink {
+	if ent.IsSymLink && ent.LinkName != "" {
 		out.Size = uint64(len(ent.LinkName))
 	}
 
 	out.Blksize = blockSize
 	out.Blocks = (out.Size + uint64(out.Blksize) - 1) / uint64(out.Blksize) * physicalBlockRatio
 
-	out.SetTimes(nil, &n.createTime, nil)
+	mtime := n.shared.current().commits.getModTime(ctx, ent.Path)
+	out.SetTimes(nil, &mtime, &mtime)
 
 	out.Mode = getEntryFileMode(ent)
 
@@ -235,10 +1027,24 @@ func (n *Node) entryToAttr(ent *types.Entry, out *fuse.Attr) fusefs.StableAttr {
 	return fusefs.StableAttr{
 		Mode: out.Mode,
 		Ino:  ino,
-		// NOTE: The inode number is unique throughout the lifetime of
-		// this filesystem so we don't consider about generation at this
-		// moment.
+		// The inode number is computed from path, the changed entry keeps
+		// its number after refreshing. The generation makes go-fuse create a
+		// new node for it, rather than reusing the old one with stale
+		// content.
+		Gen: getEntryGen(ent),
+	}
+}
+
+// getEntryGen computes the inode generation from the entry content, it is
+// changed with the entry, see isEntryChanged.
+func getEntryGen(ent *types.Entry) uint64 {
+	hash := fnv.New64a()
+	if ent.SHA != "" {
+		hash.Write([]byte(ent.SHA))
+	} else {
+		fmt.Fprintf(hash, "%o:%d:%s", getEntryFileMode(ent), ent.Size, ent.LinkName)
 	}
+	return hash.Sum64()
 }
 
 var (
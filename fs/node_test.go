@@ -2,15 +2,22 @@ package fs
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/fioncat/grfs/osutils"
 	"github.com/fioncat/grfs/types"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 type testEntry struct {
@@ -146,8 +153,13 @@ func TestNode(t *testing.T) {
 		},
 	}
 
+	cfg := &types.Config{
+		Fs: &types.FilesystemConfig{
+			EntryTimeout: time.Second * 3,
+		},
+	}
 	p := &testProvider{ents: testEntries}
-	node := NewNode(p)
+	node := NewNode(&types.Repository{}, p, nil, cfg)
 
 	mountPath := "_test/node"
 	err := osutils.EnsureDir(mountPath)
@@ -155,11 +167,7 @@ func TestNode(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	fs, err := Mount(node, mountPath, &types.Config{
-		Fs: &types.FilesystemConfig{
-			EntryTimeout: time.Second * 3,
-		},
-	})
+	fs, err := Mount(node, mountPath, cfg)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -212,3 +220,344 @@ func TestNode(t *testing.T) {
 		}
 	}
 }
+
+func TestNodeXattr(t *testing.T) {
+	commitTime := time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC)
+	p := &testCommitProvider{
+		commits: map[string]*types.Commit{
+			"main.go": {SHA: "last", Author: "fioncat", Time: commitTime},
+		},
+	}
+	repo := &types.Repository{Ref: "main", Commit: "abc"}
+	root := NewNode(repo, p, nil, &types.Config{Fs: &types.FilesystemConfig{ModTime: types.ModTimeCommit}})
+
+	ent := &types.Entry{
+		Path:   "main.go",
+		Name:   "main.go",
+		Mode:   types.GitModeFile,
+		SHA:    "blob",
+		WebUrl: "https://github.com/fioncat/grfs/blob/abc/main.go",
+	}
+	ctx := context.Background()
+	root.shared.current().commits.loadDir([]*types.Entry{ent})
+	n := newNode(ent, root.shared)
+
+	expect := map[string]string{
+		"user.grfs.weburl":            ent.WebUrl,
+		"user.grfs.sha":               "blob",
+		"user.grfs.mode":              "100644",
+		"user.grfs.ref":               "main",
+		"user.grfs.commit":            "abc",
+		"user.grfs.lastcommit.sha":    "last",
+		"user.grfs.lastcommit.author": "fioncat",
+		"user.grfs.lastcommit.date":   "2023-12-01T00:00:00Z",
+	}
+
+	size, errno := n.Listxattr(ctx, nil)
+	if errno != syscall.ERANGE {
+		t.Fatalf("Expect ERANGE for empty buffer, got %v", errno)
+	}
+	buf := make([]byte, size)
+	size, errno = n.Listxattr(ctx, buf)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	names := strings.Split(strings.TrimSuffix(string(buf[:size]), "\x00"), "\x00")
+	if len(names) != len(expect) {
+		t.Fatalf("Unexpect xattr names %v", names)
+	}
+
+	for _, name := range names {
+		buf = make([]byte, 256)
+		size, errno = n.Getxattr(ctx, name, buf)
+		if errno != 0 {
+			t.Fatalf("Get xattr %q: %v", name, errno)
+		}
+		if value := string(buf[:size]); value != expect[name] {
+			t.Fatalf("Unexpect xattr %q value %q, expect %q", name, value, expect[name])
+		}
+	}
+
+	_, errno = n.Getxattr(ctx, "user.grfs.unknown", buf)
+	if errno != syscall.ENODATA {
+		t.Fatalf("Expect ENODATA for unknown xattr, got %v", errno)
+	}
+}
+
+func TestProviderErrno(t *testing.T) {
+	cases := []struct {
+		err   error
+		errno syscall.Errno
+	}{
+		{fmt.Errorf("read file: %w", types.ErrNotFound), syscall.ENOENT},
+		{fmt.Errorf("read file: %w", types.ErrUnauthorized), syscall.EACCES},
+		{fmt.Errorf("read file: %w", types.ErrForbidden), syscall.EACCES},
+		{fmt.Errorf("read file: %w", types.ErrRateLimited), syscall.EAGAIN},
+		{fmt.Errorf("read file: %w", types.ErrTooLarge), syscall.EFBIG},
+		{fmt.Errorf("read file: %w", types.ErrTimeout), syscall.ETIMEDOUT},
+		{errors.New("unknown"), syscall.EIO},
+	}
+	for _, c := range cases {
+		if errno := providerErrno(c.err); errno != c.errno {
+			t.Fatalf("Expect %v for %q, got %v", c.errno, c.err, errno)
+		}
+	}
+}
+
+// testCtxProvider fails the requests once the context is done, like the
+// http requests do.
+type testCtxProvider struct {
+	testProvider
+}
+
+func (p *testCtxProvider) ReadDir(ctx context.Context, path string) ([]*types.Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return p.testProvider.ReadDir(ctx, path)
+}
+
+func (p *testCtxProvider) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return p.testProvider.ReadFile(ctx, path)
+}
+
+func TestNodeInterrupted(t *testing.T) {
+	p := &testCtxProvider{testProvider{ents: []*testEntry{
+		{
+			info: &types.Entry{Path: ".gitmodules", Name: ".gitmodules"},
+			data: []byte(testGitmodules),
+		},
+		{
+			info: &types.Entry{
+				Path:      "vendor/lib",
+				Name:      "lib",
+				IsDir:     true,
+				Submodule: &types.Submodule{Commit: "abc"},
+			},
+		},
+	}}}
+	root := NewNode(&types.Repository{
+		Domain: "github.com",
+		Owner:  "fioncat",
+		Name:   "grfs",
+	}, p, nil, &types.Config{Fs: &types.FilesystemConfig{}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, errno := root.Readdir(ctx)
+	if errno != syscall.EINTR {
+		t.Fatalf("Expect EINTR for interrupted readdir, got %v", errno)
+	}
+
+	url, err := root.shared.current().submodules.getURL(ctx, "vendor/lib")
+	if url != "" || err == nil {
+		t.Fatalf("Expect error for interrupted request, got %q, %v", url, err)
+	}
+	url, err = root.shared.current().submodules.getURL(context.Background(), "vendor/lib")
+	if url == "" || err != nil {
+		t.Fatalf("Expect the submodules to be read again after interrupted, got %q, %v", url, err)
+	}
+
+	ents, err := root.listSubEntries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 2 {
+		t.Fatalf("Unexpect entries %+v", ents)
+	}
+}
+
+// testNotifier records the notifications sent to the kernel.
+type testNotifier struct {
+	entries []string
+	inodes  []uint64
+
+	mu sync.Mutex
+}
+
+func (n *testNotifier) DeleteNotify(parent uint64, child uint64, name string) fuse.Status {
+	return fuse.OK
+}
+
+func (n *testNotifier) EntryNotify(parent uint64, name string) fuse.Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.entries = append(n.entries, name)
+	return fuse.OK
+}
+
+func (n *testNotifier) InodeNotify(node uint64, off int64, length int64) fuse.Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.inodes = append(n.inodes, node)
+	return fuse.OK
+}
+
+func (n *testNotifier) InodeRetrieveCache(node uint64, offset int64, dest []byte) (int, fuse.Status) {
+	return 0, fuse.OK
+}
+
+func (n *testNotifier) InodeNotifyStoreCache(node uint64, offset int64, data []byte) fuse.Status {
+	return fuse.OK
+}
+
+func (n *testNotifier) wait(t *testing.T, count int) ([]string, []uint64) {
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		n.mu.Lock()
+		entries := append([]string(nil), n.entries...)
+		inodes := append([]uint64(nil), n.inodes...)
+		n.mu.Unlock()
+		if len(entries) >= count {
+			sort.Strings(entries)
+			return entries, inodes
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expect %d notifications, got %v", count, entries)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestNodeDirCacheTTL(t *testing.T) {
+	p := &testProvider{ents: []*testEntry{
+		{info: &types.Entry{Path: "a.txt", Name: "a.txt", SHA: "a1"}},
+		{info: &types.Entry{Path: "b.txt", Name: "b.txt", SHA: "b1"}},
+		{info: &types.Entry{Path: "c.txt", Name: "c.txt", SHA: "c1"}},
+	}}
+	root := NewNode(&types.Repository{
+		Domain: "github.com",
+		Owner:  "fioncat",
+		Name:   "grfs",
+		Ref:    "main",
+	}, p, nil, &types.Config{Fs: &types.FilesystemConfig{
+		DirCacheTTL:         time.Millisecond * 100,
+		DisableTreePrefetch: true,
+	}})
+	notifier := new(testNotifier)
+	fusefs.NewNodeFS(root, &fusefs.Options{ServerCallbacks: notifier})
+
+	ents, err := root.listSubEntries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 3 {
+		t.Fatalf("Unexpect entries %+v", ents)
+	}
+	child := root.NewPersistentInode(context.Background(), &fusefs.MemRegularFile{},
+		fusefs.StableAttr{Ino: 100})
+	root.AddChild("b.txt", child, true)
+
+	// Remove "a.txt", change "b.txt" and add "d.txt" upstream.
+	p.ents = []*testEntry{
+		{info: &types.Entry{Path: "b.txt", Name: "b.txt", SHA: "b2"}},
+		{info: &types.Entry{Path: "c.txt", Name: "c.txt", SHA: "c1"}},
+		{info: &types.Entry{Path: "d.txt", Name: "d.txt", SHA: "d1"}},
+	}
+	ents, err = root.listSubEntries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 3 || ents[0].Name != "a.txt" {
+		t.Fatalf("Expect the cached entries before expired, got %+v", ents)
+	}
+
+	time.Sleep(time.Millisecond * 150)
+	ents, err = root.listSubEntries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, ent := range ents {
+		names = append(names, ent.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"b.txt", "c.txt", "d.txt"}) {
+		t.Fatalf("Expect the refreshed entries after expired, got %v", names)
+	}
+
+	notified, inodes := notifier.wait(t, 3)
+	if !reflect.DeepEqual(notified, []string{"a.txt", "b.txt", "d.txt"}) {
+		t.Fatalf("Unexpect notified entries %v", notified)
+	}
+	if len(inodes) != 1 {
+		t.Fatalf("Expect the changed inode to be notified, got %v", inodes)
+	}
+	if root.GetChild("b.txt") != nil {
+		t.Fatal("Expect the changed child to be removed")
+	}
+}
+
+func TestNodeDirCacheNeverExpire(t *testing.T) {
+	p := &testProvider{ents: []*testEntry{
+		{info: &types.Entry{Path: "a.txt", Name: "a.txt", SHA: "a1"}},
+	}}
+	root := NewNode(&types.Repository{
+		Domain: "github.com",
+		Owner:  "fioncat",
+		Name:   "grfs",
+		Ref:    "main",
+	}, p, nil, &types.Config{Fs: &types.FilesystemConfig{
+		DisableTreePrefetch: true,
+	}})
+
+	_, err := root.listSubEntries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.ents = nil
+	time.Sleep(time.Millisecond * 50)
+	ents, err := root.listSubEntries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 1 {
+		t.Fatalf("Expect the listing never expires with zero ttl, got %+v", ents)
+	}
+}
+
+func TestEntryGen(t *testing.T) {
+	testCases := []struct {
+		old     *types.Entry
+		new     *types.Entry
+		changed bool
+	}{
+		{&types.Entry{SHA: "a1"}, &types.Entry{SHA: "a1"}, false},
+		{&types.Entry{SHA: "a1"}, &types.Entry{SHA: "a2"}, true},
+		{&types.Entry{Size: 10}, &types.Entry{Size: 10}, false},
+		{&types.Entry{Size: 10}, &types.Entry{Size: 11}, true},
+		{&types.Entry{IsSymLink: true, LinkName: "a"}, &types.Entry{IsSymLink: true, LinkName: "b"}, true},
+	}
+
+	for i, tc := range testCases {
+		changed := getEntryGen(tc.old) != getEntryGen(tc.new)
+		if changed != tc.changed || changed != isEntryChanged(tc.old, tc.new) {
+			t.Fatalf("Unexpect gen changed %v, expect %v, index %d", changed, tc.changed, i)
+		}
+	}
+}
+
+func TestNodeXattrTimeout(t *testing.T) {
+	p := &testCommitProvider{block: make(chan struct{})}
+	defer close(p.block)
+	repo := &types.Repository{Ref: "main", Commit: "abc"}
+	root := NewNode(repo, p, nil, &types.Config{Fs: &types.FilesystemConfig{
+		ModTime:        types.ModTimeCommit,
+		ReadDirTimeout: time.Millisecond * 20,
+	}})
+	n := newNode(&types.Entry{Path: "main.go", Name: "main.go", SHA: "blob"}, root.shared)
+
+	// The commit lookup is bounded, the other attributes are still returned.
+	buf := make([]byte, 256)
+	size, errno := n.Listxattr(context.Background(), buf)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	names := strings.Split(strings.TrimSuffix(string(buf[:size]), "\x00"), "\x00")
+	expect := []string{"user.grfs.sha", "user.grfs.ref", "user.grfs.commit"}
+	if !reflect.DeepEqual(names, expect) {
+		t.Fatalf("Unexpect xattr names %v, expect %v", names, expect)
+	}
+}
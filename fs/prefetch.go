@@ -0,0 +1,261 @@
+package fs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/fioncat/grfs/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// prefetchQueueSize is the max number of pending prefetch tasks, the new
+	// tasks are dropped when the queue is full.
+	prefetchQueueSize = 1024
+	// prefetchMaxDirs is the max number of prefetched directory listings
+	// waiting to be used.
+	prefetchMaxDirs = 4096
+	// prefetchMinRateLimitRatio is the ratio of the remaining rate limit
+	// budget to the limit, below which prefetching stops to leave the budget
+	// to the real requests.
+	prefetchMinRateLimitRatio = 0.2
+)
+
+// prefetcher fetches the sub directory listings and small files of a listed
+// directory ahead of time in background, with a bounded worker pool. The
+// listings are kept until the directory nodes read them, and the files are
+// put to the blob cache.
+type prefetcher struct {
+	cfg *types.FilesystemConfig
+
+	tasks chan *prefetchTask
+
+	// ctx is canceled when the prefetcher is stopped, to stop the workers
+	// and interrupt the running fetches.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	dirs map[string]*prefetchedDir
+
+	mu sync.Mutex
+}
+
+type prefetchTask struct {
+	shared *nodeShared
+	// state is the one the entry is listed from.
+	state *repoState
+	entry *types.Entry
+
+	// depth is the remaining directory levels to prefetch below the entry.
+	depth int
+}
+
+type prefetchedDir struct {
+	ents     []*types.Entry
+	loadTime time.Time
+}
+
+func newPrefetcher(cfg *types.FilesystemConfig) *prefetcher {
+	if cfg.PrefetchDepth <= 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &prefetcher{
+		cfg:    cfg,
+		tasks:  make(chan *prefetchTask, prefetchQueueSize),
+		ctx:    ctx,
+		cancel: cancel,
+		dirs:   make(map[string]*prefetchedDir),
+	}
+	for i := 0; i < cfg.PrefetchWorkers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// schedule prefetches the sub directories and small files of a listed
+// directory. The sub directories are listed if depth is greater than zero.
+func (p *prefetcher) schedule(shared *nodeShared, state *repoState, ents []*types.Entry, depth int) {
+	if p == nil || p.ctx.Err() != nil {
+		return
+	}
+
+	for _, ent := range ents {
+		switch {
+		case ent.Submodule != nil || ent.IsSymLink:
+			continue
+
+		case ent.IsDir:
+			if depth <= 0 || p.has(state.flightKey("readdir", ent.Path)) {
+				continue
+			}
+
+		default:
+			if shared.cache == nil || ent.Size <= 0 || ent.Size > int64(p.cfg.PrefetchFileSize) {
+				continue
+			}
+		}
+
+		select {
+		case p.tasks <- &prefetchTask{shared: shared, state: state, entry: ent, depth: depth - 1}:
+		default:
+			// The queue is full, the entries will be fetched on demand.
+			return
+		}
+	}
+}
+
+func (p *prefetcher) work() {
+	for {
+		var task *prefetchTask
+		select {
+		case task = <-p.tasks:
+		case <-p.ctx.Done():
+			return
+		}
+
+		if task.state.isRateLimitLow() {
+			logrus.Debugf("Rate limit budget is low, skip prefetching %q", task.entry.Path)
+			continue
+		}
+
+		var err error
+		if task.entry.IsDir {
+			err = p.prefetchDir(task)
+		} else {
+			err = p.prefetchFile(task)
+		}
+		if err != nil {
+			logrus.Debugf("Prefetch %q error: %v", task.entry.Path, err)
+		}
+	}
+}
+
+// stop stops the workers, the pending tasks are dropped.
+func (p *prefetcher) stop() {
+	if p == nil {
+		return
+	}
+	p.cancel()
+}
+
+// reset drops the prefetched listings, which are loaded from the replaced
+// repository states and would never be taken.
+func (p *prefetcher) reset() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dirs = make(map[string]*prefetchedDir)
+}
+
+func (p *prefetcher) prefetchDir(task *prefetchTask) error {
+	shared, state := task.shared, task.state
+	ctx, cancel := withTimeout(p.ctx, shared.cfg.ReadDirTimeout)
+	defer cancel()
+
+	ents, ok := state.tree.readDir(ctx, task.entry.Path)
+	if !ok {
+		key := state.flightKey("readdir", task.entry.Path)
+		if p.has(key) {
+			return nil
+		}
+
+		var err error
+		ents, err = newNode(task.entry, shared).fetchDir(ctx, state, key)
+		if err != nil {
+			return err
+		}
+		p.put(key, ents)
+	}
+
+	p.schedule(shared, state, ents, task.depth)
+	return nil
+}
+
+func (p *prefetcher) prefetchFile(task *prefetchTask) error {
+	shared, state := task.shared, task.state
+	cacheKey := types.BlobCacheKey(state.repo, task.entry)
+	if cacheKey == "" {
+		return nil
+	}
+	_, ok, err := shared.cache.Get(cacheKey)
+	if err != nil || ok {
+		return err
+	}
+
+	ctx, cancel := withTimeout(p.ctx, shared.cfg.ReadFileTimeout)
+	defer cancel()
+
+	node := newNode(task.entry, shared)
+	_, err = shared.flights.do(ctx, state.flightKey("read", task.entry.Path), func(ctx context.Context) (interface{}, error) {
+		return node.downloadContent(ctx, state, cacheKey)
+	})
+	return err
+}
+
+func (p *prefetcher) has(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.dirs[key]
+	return ok
+}
+
+func (p *prefetcher) put(key string, ents []*types.Entry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.dirs) >= prefetchMaxDirs {
+		for key, dir := range p.dirs {
+			if p.expired(dir) {
+				delete(p.dirs, key)
+			}
+		}
+		if len(p.dirs) >= prefetchMaxDirs {
+			return
+		}
+	}
+	p.dirs[key] = &prefetchedDir{ents: ents, loadTime: time.Now()}
+}
+
+// take returns the prefetched listing of key, and removes it, since the
+// directory node caches it since then.
+func (p *prefetcher) take(key string) ([]*types.Entry, bool) {
+	if p == nil {
+		return nil, false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	dir, ok := p.dirs[key]
+	if !ok {
+		return nil, false
+	}
+	delete(p.dirs, key)
+	if p.expired(dir) {
+		return nil, false
+	}
+	return dir.ents, true
+}
+
+func (p *prefetcher) expired(dir *prefetchedDir) bool {
+	return p.cfg.DirCacheTTL > 0 && time.Since(dir.loadTime) > p.cfg.DirCacheTTL
+}
+
+// isRateLimitLow reports whether the rate limit budget of provider is too
+// low to prefetch.
+func (st *repoState) isRateLimitLow() bool {
+	reporter, ok := st.provider.(types.RateLimitReporter)
+	if !ok {
+		return false
+	}
+	rateLimit := reporter.RateLimit()
+	if rateLimit == nil || time.Now().Unix() >= rateLimit.Reset {
+		return false
+	}
+	return float64(rateLimit.Remaining) < float64(rateLimit.Limit)*prefetchMinRateLimitRatio
+}
@@ -0,0 +1,210 @@
+package fs
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fioncat/grfs/types"
+)
+
+type testCountProvider struct {
+	testProvider
+
+	readDirs  atomic.Int32
+	readFiles atomic.Int32
+
+	rateLimit *types.RateLimit
+}
+
+func (p *testCountProvider) ReadDir(ctx context.Context, path string) ([]*types.Entry, error) {
+	p.readDirs.Add(1)
+	return p.testProvider.ReadDir(ctx, path)
+}
+
+func (p *testCountProvider) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	p.readFiles.Add(1)
+	return p.testProvider.ReadFile(ctx, path)
+}
+
+func (p *testCountProvider) RateLimit() *types.RateLimit { return p.rateLimit }
+
+type testMemCache struct {
+	blobs map[string][]byte
+	mu    sync.Mutex
+}
+
+func (c *testMemCache) Get(key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.blobs[key]
+	return data, ok, nil
+}
+
+func (c *testMemCache) Put(key string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.blobs[key] = data
+	return nil
+}
+
+func newTestPrefetchProvider() *testCountProvider {
+	return &testCountProvider{testProvider: testProvider{ents: []*testEntry{
+		{
+			info: &types.Entry{Path: "small.txt", Name: "small.txt", SHA: "small"},
+			data: []byte("hello"),
+		},
+		{
+			info: &types.Entry{Path: "large.txt", Name: "large.txt", SHA: "large"},
+			data: make([]byte, 1024),
+		},
+		{
+			info: &types.Entry{Path: "src", Name: "src", IsDir: true},
+			children: []*testEntry{
+				{info: &types.Entry{Path: "src/pkg", Name: "pkg", IsDir: true}},
+			},
+		},
+	}}}
+}
+
+func newTestPrefetchRoot(p *testCountProvider, cache *testMemCache) *Node {
+	return NewNode(&types.Repository{
+		Domain: "github.com",
+		Owner:  "fioncat",
+		Name:   "grfs",
+	}, p, cache, &types.Config{Fs: &types.FilesystemConfig{
+		PrefetchDepth:    1,
+		PrefetchWorkers:  2,
+		PrefetchFileSize: 512,
+		ReadDirTimeout:   time.Second,
+		ReadFileTimeout:  time.Second,
+	}})
+}
+
+func TestPrefetch(t *testing.T) {
+	p := newTestPrefetchProvider()
+	cache := &testMemCache{blobs: make(map[string][]byte)}
+	root := newTestPrefetchRoot(p, cache)
+
+	_, err := root.listSubEntries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := root.shared.current().flightKey("readdir", "src")
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		_, cached, _ := cache.Get("blob/small")
+		if cached && root.shared.prefetcher.has(key) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Prefetch timeout")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if _, ok, _ := cache.Get("blob/large"); ok {
+		t.Fatal("The large file should not be prefetched")
+	}
+	// Depth 1 lists "src" but not "src/pkg".
+	time.Sleep(time.Millisecond * 50)
+	if n := p.readDirs.Load(); n != 2 {
+		t.Fatalf("Expect 2 readdir calls, got %d", n)
+	}
+	if n := p.readFiles.Load(); n != 1 {
+		t.Fatalf("Expect 1 readfile call, got %d", n)
+	}
+
+	src := newNode(&types.Entry{Path: "src", Name: "src", IsDir: true}, root.shared)
+	ents, err := src.readDir(context.Background(), root.shared.current())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 1 || ents[0].Path != "src/pkg" {
+		t.Fatalf("Unexpect entries %+v", ents)
+	}
+	if n := p.readDirs.Load(); n != 2 {
+		t.Fatalf("Expect the prefetched listing to be used, got %d readdir calls", n)
+	}
+	if root.shared.prefetcher.has(key) {
+		t.Fatal("Expect the prefetched listing to be taken")
+	}
+}
+
+func TestPrefetchRateLimit(t *testing.T) {
+	p := newTestPrefetchProvider()
+	p.rateLimit = &types.RateLimit{
+		Limit:     100,
+		Remaining: 10,
+		Reset:     time.Now().Add(time.Hour).Unix(),
+	}
+	cache := &testMemCache{blobs: make(map[string][]byte)}
+	root := newTestPrefetchRoot(p, cache)
+
+	_, err := root.listSubEntries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	if n := p.readDirs.Load(); n != 1 {
+		t.Fatalf("Expect no prefetch with low rate limit, got %d readdir calls", n)
+	}
+	if n := p.readFiles.Load(); n != 0 {
+		t.Fatalf("Expect no prefetch with low rate limit, got %d readfile calls", n)
+	}
+}
+
+func TestPrefetchStop(t *testing.T) {
+	p := newTestPrefetchProvider()
+	cache := &testMemCache{blobs: make(map[string][]byte)}
+	root := newTestPrefetchRoot(p, cache)
+	if err := root.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := root.listSubEntries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	if n := p.readDirs.Load(); n != 1 {
+		t.Fatalf("Expect no prefetch after stopped, got %d readdir calls", n)
+	}
+	if n := p.readFiles.Load(); n != 0 {
+		t.Fatalf("Expect no prefetch after stopped, got %d readfile calls", n)
+	}
+}
+
+func TestPrefetchReset(t *testing.T) {
+	p := newTestPrefetchProvider()
+	cache := &testMemCache{blobs: make(map[string][]byte)}
+	root := newTestPrefetchRoot(p, cache)
+	defer root.Close()
+
+	_, err := root.listSubEntries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := root.shared.current().flightKey("readdir", "src")
+	deadline := time.Now().Add(time.Second * 5)
+	for !root.shared.prefetcher.has(key) {
+		if time.Now().After(deadline) {
+			t.Fatal("Prefetch timeout")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	state := root.shared.current()
+	root.shared.setState(state.repo, state.provider)
+	root.shared.prefetcher.mu.Lock()
+	n := len(root.shared.prefetcher.dirs)
+	root.shared.prefetcher.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("Expect the stale listings to be dropped, got %d", n)
+	}
+}
@@ -0,0 +1,412 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fioncat/grfs/types"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	_ = (types.DaemonController)((*RefsNode)(nil))
+
+	_ = (fusefs.NodeReaddirer)((*RefsNode)(nil))
+	_ = (fusefs.NodeLookuper)((*RefsNode)(nil))
+	_ = (fusefs.NodeGetattrer)((*RefsNode)(nil))
+)
+
+const (
+	refsBranches = "@branches"
+	refsTags     = "@tags"
+	refsCommits  = "@commits"
+)
+
+// RefsNode is a directory of the multi-ref layout. The root holds
+// "@branches", "@tags" and "@commits", and each ref under them is a view of
+// the repository at that ref, loaded on demand. The ref names containing "/"
+// are shown as nested directories.
+type RefsNode struct {
+	fusefs.Inode
+	readOnlyNode
+
+	// base is the node of the mounted repository, which holds the shared
+	// states for ref views.
+	base *Node
+
+	// kind is empty for the root.
+	kind string
+	// prefix is the ref name prefix of a nested directory, such as "feature"
+	// for the branch "feature/login".
+	prefix string
+
+	refs *refList
+
+	// missing holds the refs failed to load as not found, with the gen they
+	// were loaded in, so that looking up a bad commit does not request again
+	// until refreshed.
+	missing   map[string]uint64
+	missingMu sync.Mutex
+}
+
+// refList caches the branch or tag names of the repository.
+type refList struct {
+	list func(ctx context.Context) ([]string, error)
+	ttl  time.Duration
+	gen  func() uint64
+
+	// flights coalesces the concurrent listings, the list is not locked
+	// during them.
+	flights *flightGroup
+	key     func() string
+
+	names    []string
+	loadTime time.Time
+	loadGen  uint64
+	loaded   bool
+
+	mu sync.Mutex
+}
+
+func NewRefsNode(repo *types.Repository, prov types.Provider, cache types.BlobCache, cfg *types.Config) *RefsNode {
+	return &RefsNode{base: NewNode(repo, prov, cache, cfg)}
+}
+
+func (r *RefsNode) Repository() *types.Repository {
+	return r.base.Repository()
+}
+
+func (r *RefsNode) Stats() *types.FilesystemStats {
+	return r.base.Stats()
+}
+
+func (r *RefsNode) Refresh(ctx context.Context) error {
+	err := r.base.Refresh(ctx)
+	if err != nil {
+		return err
+	}
+	// The branch views are pinned to the commits resolved when looking up,
+	// drop them to resolve again. The tag and commit views never move.
+	if child := r.GetChild(refsBranches); child != nil {
+		if dir, ok := child.Operations().(*RefsNode); ok {
+			dir.dropViews()
+		}
+	}
+	return nil
+}
+
+// dropViews removes the ref views under the directory, and tells the kernel
+// to forget them, so that they are looked up again.
+func (r *RefsNode) dropViews() {
+	var names []string
+	for name, child := range r.Children() {
+		switch subNode := child.Operations().(type) {
+		case *RefsNode:
+			subNode.dropViews()
+		case *Node:
+			names = append(names, name)
+			r.RmChild(name)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+
+	// The kernel might hold the directory lock while we are handling its
+	// operation, notify it asynchronously to avoid deadlock.
+	go func() {
+		for _, name := range names {
+			errno := r.NotifyEntry(name)
+			if errno != 0 {
+				logrus.Debugf("Notify ref view %q error: %v", path.Join(r.getPath(), name), errno)
+			}
+		}
+	}()
+}
+
+func (r *RefsNode) Checkout(ctx context.Context, ref string) error {
+	return r.base.Checkout(ctx, ref)
+}
+
+func (r *RefsNode) Close() error {
+	return r.base.Close()
+}
+
+func (r *RefsNode) getRefList(kind string) *refList {
+	lister, ok := r.base.shared.current().provider.(types.RefLister)
+	if !ok {
+		return nil
+	}
+
+	shared := r.base.shared
+	list := &refList{
+		ttl:     shared.cfg.DirCacheTTL,
+		gen:     shared.gen.Load,
+		flights: shared.flights,
+		key: func() string {
+			return shared.current().flightKey("refs", kind)
+		},
+	}
+	switch kind {
+	case refsBranches:
+		list.list = lister.ListBranches
+	case refsTags:
+		list.list = lister.ListTags
+	default:
+		return nil
+	}
+	return list
+}
+
+func (r *RefsNode) getPath() string {
+	return path.Join(r.kind, r.prefix)
+}
+
+func (r *RefsNode) getIno(name string) uint64 {
+	return r.base.shared.inodes.get(path.Join(r.getPath(), name))
+}
+
+func (r *RefsNode) fillAttr(out *fuse.Attr) {
+	out.Ino = r.getIno("")
+	out.Mode = getEntryFileMode(&types.Entry{IsDir: true})
+	out.Owner = r.base.getOwner()
+
+	startTime := r.base.shared.stats.startTime
+	out.SetTimes(nil, &startTime, &startTime)
+}
+
+func (r *RefsNode) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	r.fillAttr(&out.Attr)
+	return 0
+}
+
+func (r *RefsNode) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
+	ctx, cancel := withTimeout(ctx, r.base.shared.cfg.ReadDirTimeout)
+	defer cancel()
+
+	names, err := r.listNames(ctx)
+	if err != nil {
+		logrus.Errorf("List refs %q error: %v", r.getPath(), err)
+		return nil, providerErrno(err)
+	}
+
+	ents := make([]fuse.DirEntry, 0, len(names)+1)
+	for _, name := range names {
+		ents = append(ents, fuse.DirEntry{
+			Mode: syscall.S_IFDIR,
+			Name: name,
+			Ino:  r.getIno(name),
+		})
+	}
+	if r.kind == "" {
+		ents = append(ents, r.base.controlDirEntry())
+	}
+	return fusefs.NewListDirStream(ents), 0
+}
+
+// listNames returns the names of sub directories.
+func (r *RefsNode) listNames(ctx context.Context) ([]string, error) {
+	switch {
+	case r.kind == "":
+		names := []string{refsCommits}
+		if _, ok := r.base.shared.current().provider.(types.RefLister); ok {
+			names = append([]string{refsBranches, refsTags}, names...)
+		}
+		return names, nil
+
+	case r.refs == nil:
+		// The commits cannot be listed, they can only be looked up.
+		return nil, nil
+	}
+
+	refs, err := r.refs.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	seen := make(map[string]struct{})
+	for _, ref := range refs {
+		name, ok := r.trimPrefix(ref)
+		if !ok {
+			continue
+		}
+		name, _, _ = strings.Cut(name, "/")
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (r *RefsNode) trimPrefix(ref string) (string, bool) {
+	if r.prefix == "" {
+		return ref, true
+	}
+	return strings.CutPrefix(ref, r.prefix+"/")
+}
+
+func (r *RefsNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	if r.kind == "" && name == r.base.shared.cfg.ControlDir {
+		return r.base.lookupControlDir(ctx, &r.Inode, r, out), 0
+	}
+
+	ctx, cancel := withTimeout(ctx, r.base.shared.cfg.ReadDirTimeout)
+	defer cancel()
+
+	if child := r.GetChild(name); child != nil {
+		switch subNode := child.Operations().(type) {
+		case *RefsNode:
+			subNode.fillAttr(&out.Attr)
+		case *Node:
+			subNode.entryToAttr(ctx, subNode.entry, &out.Attr)
+		default:
+			return nil, syscall.EIO
+		}
+		return child, 0
+	}
+
+	if r.kind == "" {
+		names, _ := r.listNames(ctx)
+		for _, kind := range names {
+			if kind != name {
+				continue
+			}
+			subNode := &RefsNode{base: r.base, kind: kind, refs: r.getRefList(kind)}
+			subNode.fillAttr(&out.Attr)
+			return r.NewInode(ctx, subNode, fusefs.StableAttr{Mode: syscall.S_IFDIR, Ino: out.Attr.Ino}), 0
+		}
+		return nil, syscall.ENOENT
+	}
+
+	ref := path.Join(r.prefix, name)
+	if r.refs != nil {
+		refs, err := r.refs.get(ctx)
+		if err != nil {
+			logrus.Errorf("List refs %q error: %v", r.getPath(), err)
+			return nil, providerErrno(err)
+		}
+
+		var found, nested bool
+		for _, candidate := range refs {
+			if candidate == ref {
+				found = true
+				break
+			}
+			if strings.HasPrefix(candidate, ref+"/") {
+				nested = true
+			}
+		}
+		if !found {
+			if !nested {
+				return nil, syscall.ENOENT
+			}
+			subNode := &RefsNode{base: r.base, kind: r.kind, prefix: ref, refs: r.refs}
+			subNode.fillAttr(&out.Attr)
+			return r.NewInode(ctx, subNode, fusefs.StableAttr{Mode: syscall.S_IFDIR, Ino: out.Attr.Ino}), 0
+		}
+	}
+
+	if r.isMissing(name) {
+		return nil, syscall.ENOENT
+	}
+	gen := r.base.shared.gen.Load()
+	shared, err := r.base.shared.loadRef(ctx, ref, path.Join(r.kind, ref))
+	if err != nil {
+		logrus.Warnf("Load ref %q error: %v", ref, err)
+		// The unknown refs are not always reported as not found, such as
+		// the invalid commit SHAs.
+		errno := providerErrno(err)
+		if errno == syscall.EIO {
+			errno = syscall.ENOENT
+		}
+		if errno == syscall.ENOENT {
+			r.setMissing(name, gen)
+		}
+		return nil, errno
+	}
+	// The commit is used as SHA, so that the view of a moved branch gets a
+	// new inode generation, see getEntryGen.
+	subNode := newNode(&types.Entry{Name: name, IsDir: true, SHA: shared.current().repo.Commit}, shared)
+	subAttr := subNode.entryToAttr(ctx, subNode.entry, &out.Attr)
+	return r.NewInode(ctx, subNode, subAttr), 0
+}
+
+func (r *RefsNode) isMissing(name string) bool {
+	r.missingMu.Lock()
+	defer r.missingMu.Unlock()
+	gen, ok := r.missing[name]
+	return ok && gen == r.base.shared.gen.Load()
+}
+
+func (r *RefsNode) setMissing(name string, gen uint64) {
+	r.missingMu.Lock()
+	defer r.missingMu.Unlock()
+	if r.missing == nil {
+		r.missing = make(map[string]uint64)
+	}
+	for name, missingGen := range r.missing {
+		// Drop the refs missing in older gens, they are looked up again.
+		if missingGen != gen {
+			delete(r.missing, name)
+		}
+	}
+	r.missing[name] = gen
+}
+
+// loadRef loads the view of the repository at ref, mounted on prefix. The
+// view is pinned to the commit resolved from ref, unless following.
+func (s *nodeShared) loadRef(ctx context.Context, ref, prefix string) (*nodeShared, error) {
+	repo := *s.current().repo
+	repo.Ref, repo.Commit = ref, ""
+	repo.MultiRef = false
+
+	prov, err := s.loadProvider(&repo)
+	if err != nil {
+		return nil, fmt.Errorf("load provider: %w", err)
+	}
+	err = prov.Check(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("check repository: %w", err)
+	}
+
+	logrus.Infof("Load ref view %q as %s, commit %s", prefix, repo.String(), repo.Commit)
+	return s.withRepo(&repo, prov, prefix), nil
+}
+
+func (l *refList) get(ctx context.Context) ([]string, error) {
+	l.mu.Lock()
+	if l.loaded && l.loadGen == l.gen() && (l.ttl <= 0 || time.Since(l.loadTime) <= l.ttl) {
+		names := l.names
+		l.mu.Unlock()
+		return names, nil
+	}
+	gen := l.gen()
+	l.mu.Unlock()
+
+	val, err := l.flights.do(ctx, l.key(), func(ctx context.Context) (interface{}, error) {
+		return l.list(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Sort a copy, the result is shared by the coalesced callers.
+	names := append([]string(nil), val.([]string)...)
+	sort.Strings(names)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.names, l.loaded = names, true
+	l.loadTime, l.loadGen = time.Now(), gen
+	return names, nil
+}
@@ -0,0 +1,238 @@
+package fs
+
+import (
+	"context"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/fioncat/grfs/types"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+type testRefListProvider struct {
+	testRefProvider
+
+	branches []string
+	lists    int
+}
+
+func (p *testRefListProvider) ListBranches(ctx context.Context) ([]string, error) {
+	p.lists++
+	return p.branches, nil
+}
+
+func (p *testRefListProvider) ListTags(ctx context.Context) ([]string, error) {
+	return []string{"v1.0"}, nil
+}
+
+func TestRefsNode(t *testing.T) {
+	repo := &types.Repository{Ref: "main", Commit: "c1", MultiRef: true}
+	p := &testRefListProvider{
+		testRefProvider: testRefProvider{
+			repo: repo,
+			refs: map[string]string{"main": "c1", "feature/login": "c2"},
+		},
+		branches: []string{"main", "feature/login", "feature/logout", "dev"},
+	}
+	cfg := &types.Config{Fs: &types.FilesystemConfig{ControlDir: ".grfs"}}
+	root := NewRefsNode(repo, p, nil, cfg)
+	ctx := context.Background()
+
+	names, err := root.listNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{refsBranches, refsTags, refsCommits}
+	if !reflect.DeepEqual(names, expect) {
+		t.Fatalf("Unexpect root names %v, expect %v", names, expect)
+	}
+
+	branches := &RefsNode{base: root.base, kind: refsBranches, refs: root.getRefList(refsBranches)}
+	names, err = branches.listNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = []string{"dev", "feature", "main"}
+	if !reflect.DeepEqual(names, expect) {
+		t.Fatalf("Unexpect branch names %v, expect %v", names, expect)
+	}
+
+	nested := &RefsNode{base: root.base, kind: refsBranches, prefix: "feature", refs: branches.refs}
+	names, err = nested.listNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = []string{"login", "logout"}
+	if !reflect.DeepEqual(names, expect) {
+		t.Fatalf("Unexpect nested branch names %v, expect %v", names, expect)
+	}
+	if p.lists != 1 {
+		t.Fatalf("Expect branches to be listed once, listed %d", p.lists)
+	}
+
+	err = root.base.shared.refresh(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = branches.listNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.lists != 2 {
+		t.Fatalf("Expect branches to be listed again after refresh, listed %d", p.lists)
+	}
+
+	var loaded *types.Repository
+	root.base.shared.loadProvider = func(repo *types.Repository) (types.Provider, error) {
+		loaded = repo
+		return &testRefProvider{repo: repo, refs: p.refs}, nil
+	}
+	shared, err := root.base.shared.loadRef(ctx, "feature/login", "@branches/feature/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Ref != "feature/login" || loaded.Commit != "c2" || loaded.MultiRef {
+		t.Fatalf("Unexpect ref view repo %+v", loaded)
+	}
+	if shared.prefix != "@branches/feature/login" {
+		t.Fatalf("Unexpect ref view prefix %q", shared.prefix)
+	}
+	if repo.Ref != "main" || repo.Commit != "c1" {
+		t.Fatalf("Expect base repo to be kept, got %s, %s", repo.Ref, repo.Commit)
+	}
+
+	_, err = root.base.shared.loadRef(ctx, "unknown", "@commits/unknown")
+	if err == nil {
+		t.Fatal("Expect error when loading unknown ref")
+	}
+}
+
+func TestRefsNodeRefresh(t *testing.T) {
+	repo := &types.Repository{Ref: "main", MultiRef: true}
+	refs := map[string]string{"main": "c1"}
+	p := &testRefListProvider{
+		testRefProvider: testRefProvider{repo: repo, refs: refs},
+		branches:        []string{"main"},
+	}
+	root := NewRefsNode(repo, p, nil, &types.Config{Fs: &types.FilesystemConfig{
+		DisableTreePrefetch: true,
+	}})
+	var loads int
+	root.base.shared.loadProvider = func(repo *types.Repository) (types.Provider, error) {
+		loads++
+		return &testRefListProvider{
+			testRefProvider: testRefProvider{repo: repo, refs: refs},
+			branches:        p.branches,
+		}, nil
+	}
+	fusefs.NewNodeFS(root, &fusefs.Options{ServerCallbacks: new(testNotifier)})
+	ctx := context.Background()
+
+	lookupView := func() *Node {
+		// Add the children as the kernel looks them up, so that they are
+		// kept across lookups.
+		dir, errno := root.Lookup(ctx, refsBranches, new(fuse.EntryOut))
+		if errno != 0 {
+			t.Fatalf("Lookup branches: %v", errno)
+		}
+		root.AddChild(refsBranches, dir, false)
+		view, errno := dir.Operations().(*RefsNode).Lookup(ctx, "main", new(fuse.EntryOut))
+		if errno != 0 {
+			t.Fatalf("Lookup branch view: %v", errno)
+		}
+		dir.AddChild("main", view, false)
+		return view.Operations().(*Node)
+	}
+
+	if commit := lookupView().shared.current().repo.Commit; commit != "c1" {
+		t.Fatalf("Unexpect view commit %q, expect c1", commit)
+	}
+
+	// The branch moves upstream, the view should follow it after refreshing.
+	refs["main"] = "c2"
+	err := root.Refresh(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit := lookupView().shared.current().repo.Commit; commit != "c2" {
+		t.Fatalf("Unexpect view commit %q after refresh, expect c2", commit)
+	}
+
+	// The bad commits are not loaded again until refreshed.
+	commits, errno := root.Lookup(ctx, refsCommits, new(fuse.EntryOut))
+	if errno != 0 {
+		t.Fatalf("Lookup commits: %v", errno)
+	}
+	loads = 0
+	for i := 0; i < 3; i++ {
+		_, errno = commits.Operations().(*RefsNode).Lookup(ctx, "bad", new(fuse.EntryOut))
+		if errno != syscall.ENOENT {
+			t.Fatalf("Expect ENOENT for bad commit, got %v", errno)
+		}
+	}
+	if loads != 1 {
+		t.Fatalf("Expect bad commit to be loaded once, loaded %d", loads)
+	}
+}
+
+func TestRefsNodeControlRefresh(t *testing.T) {
+	repo := &types.Repository{Ref: "main", MultiRef: true}
+	refs := map[string]string{"main": "c1"}
+	p := &testRefListProvider{
+		testRefProvider: testRefProvider{repo: repo, refs: refs},
+		branches:        []string{"main"},
+	}
+	root := NewRefsNode(repo, p, nil, &types.Config{Fs: &types.FilesystemConfig{
+		ControlDir:          ".grfs",
+		ControlWritable:     true,
+		DisableTreePrefetch: true,
+	}})
+	root.base.shared.loadProvider = func(repo *types.Repository) (types.Provider, error) {
+		return &testRefListProvider{
+			testRefProvider: testRefProvider{repo: repo, refs: refs},
+			branches:        p.branches,
+		}, nil
+	}
+	fusefs.NewNodeFS(root, &fusefs.Options{ServerCallbacks: new(testNotifier)})
+	ctx := context.Background()
+
+	lookupView := func() *Node {
+		// Add the children as the kernel looks them up, so that they are
+		// kept across lookups.
+		dir, errno := root.Lookup(ctx, refsBranches, new(fuse.EntryOut))
+		if errno != 0 {
+			t.Fatalf("Lookup branches: %v", errno)
+		}
+		root.AddChild(refsBranches, dir, false)
+		view, errno := dir.Operations().(*RefsNode).Lookup(ctx, "main", new(fuse.EntryOut))
+		if errno != 0 {
+			t.Fatalf("Lookup branch view: %v", errno)
+		}
+		dir.AddChild("main", view, false)
+		return view.Operations().(*Node)
+	}
+	if commit := lookupView().shared.current().repo.Commit; commit != "c1" {
+		t.Fatalf("Unexpect view commit %q, expect c1", commit)
+	}
+
+	control, errno := root.Lookup(ctx, ".grfs", new(fuse.EntryOut))
+	if errno != 0 {
+		t.Fatalf("Lookup control dir: %v", errno)
+	}
+	refresh, errno := control.Operations().(*controlDir).Lookup(ctx, "refresh", new(fuse.EntryOut))
+	if errno != 0 {
+		t.Fatalf("Lookup refresh control file: %v", errno)
+	}
+
+	// Writing the control file refreshes the whole mount, including the
+	// branch views.
+	refs["main"] = "c2"
+	if errno := writeControlFile(refresh.Operations().(*controlFile), "1"); errno != 0 {
+		t.Fatalf("Write refresh control file: %v", errno)
+	}
+	if commit := lookupView().shared.current().repo.Commit; commit != "c2" {
+		t.Fatalf("Unexpect view commit %q after refresh, expect c2", commit)
+	}
+}
@@ -0,0 +1,100 @@
+package fs
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fioncat/grfs/types"
+)
+
+// fsStats holds the counters of a mounted filesystem.
+type fsStats struct {
+	startTime time.Time
+
+	readDirs   atomic.Int64
+	readFiles  atomic.Int64
+	readRanges atomic.Int64
+
+	downloadBytes atomic.Int64
+
+	cacheHits   atomic.Int64
+	cacheMisses atomic.Int64
+
+	errors atomic.Int64
+}
+
+func newFsStats() *fsStats {
+	return &fsStats{startTime: time.Now()}
+}
+
+func (s *nodeShared) getStats() *types.FilesystemStats {
+	stats := &types.FilesystemStats{
+		ReadDirs:   s.stats.readDirs.Load(),
+		ReadFiles:  s.stats.readFiles.Load(),
+		ReadRanges: s.stats.readRanges.Load(),
+
+		DownloadBytes: s.stats.downloadBytes.Load(),
+
+		CacheHits:   s.stats.cacheHits.Load(),
+		CacheMisses: s.stats.cacheMisses.Load(),
+
+		BufferSize:     s.buffers.getSize(),
+		ChunkCacheSize: s.chunks.getSize(),
+
+		Errors: s.stats.errors.Load(),
+	}
+	if reporter, ok := s.current().provider.(types.RateLimitReporter); ok {
+		stats.RateLimit = reporter.RateLimit()
+	}
+	return stats
+}
+
+type errorRecord struct {
+	time time.Time
+	path string
+	msg  string
+}
+
+// errorLogSize is the max number of recent errors kept in memory.
+const errorLogSize = 100
+
+// errorLog keeps the recent errors of the filesystem, the oldest ones are
+// dropped when it is full.
+type errorLog struct {
+	records []errorRecord
+
+	mu sync.Mutex
+}
+
+func (l *errorLog) add(path string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.records) >= errorLogSize {
+		copy(l.records, l.records[1:])
+		l.records = l.records[:len(l.records)-1]
+	}
+	l.records = append(l.records, errorRecord{
+		time: time.Now(),
+		path: path,
+		msg:  err.Error(),
+	})
+}
+
+func (l *errorLog) format() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var sb strings.Builder
+	for _, record := range l.records {
+		path := record.path
+		if path == "" {
+			path = "/"
+		}
+		fmt.Fprintf(&sb, "%s %s: %s\n", record.time.Format(time.RFC3339), path, record.msg)
+	}
+	return sb.String()
+}
@@ -0,0 +1,201 @@
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/fioncat/grfs/types"
+	"github.com/sirupsen/logrus"
+)
+
+const gitmodulesPath = ".gitmodules"
+
+// errBadSubmodule is returned when a submodule can never be loaded, such as
+// its url is missing or its repository is not found. Such submodules are
+// shown as empty directories.
+var errBadSubmodule = errors.New("bad submodule")
+
+// submoduleIndex holds the submodule urls of a repository, read from the
+// ".gitmodules" file on demand.
+type submoduleIndex struct {
+	provider types.Provider
+
+	urls   map[string]string
+	loaded bool
+
+	mu sync.Mutex
+}
+
+func newSubmoduleIndex(provider types.Provider) *submoduleIndex {
+	return &submoduleIndex{provider: provider}
+}
+
+// fill sets the urls for submodule entries. The entries are replaced by
+// copies, since they might be shared with the tree index.
+func (s *submoduleIndex) fill(ctx context.Context, ents []*types.Entry) {
+	for i, ent := range ents {
+		if ent.Submodule == nil {
+			continue
+		}
+
+		submodule := *ent.Submodule
+		// The url is read again when loading the submodule if failed.
+		submodule.URL, _ = s.getURL(ctx, ent.Path)
+
+		copied := *ent
+		copied.Submodule = &submodule
+		ents[i] = &copied
+	}
+}
+
+// getURL returns the url of the submodule on path, empty if not found. An
+// error is returned if the ".gitmodules" cannot be read for now, it is read
+// again by the next caller.
+func (s *submoduleIndex) getURL(ctx context.Context, path string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.loaded {
+		data, err := s.provider.ReadFile(ctx, gitmodulesPath)
+		switch {
+		case err == nil:
+			s.urls = parseGitmodules(data)
+			s.loaded = true
+		case ctx.Err() != nil:
+			// The request was interrupted.
+			return "", ctx.Err()
+		case errors.Is(err, types.ErrNotFound):
+			logrus.Warnf("Read %s error: %v, submodules will be shown as empty directories", gitmodulesPath, err)
+			s.loaded = true
+		default:
+			logrus.Warnf("Read %s error: %v, will read again", gitmodulesPath, err)
+			return "", err
+		}
+	}
+
+	return s.urls[path], nil
+}
+
+// parseGitmodules parses the ".gitmodules" file, returns the submodule urls
+// by their paths.
+func parseGitmodules(data []byte) map[string]string {
+	urls := make(map[string]string)
+
+	var modulePath, moduleURL string
+	flush := func() {
+		if modulePath != "" && moduleURL != "" {
+			urls[modulePath] = moduleURL
+		}
+		modulePath, moduleURL = "", ""
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			flush()
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch key {
+		case "path":
+			modulePath = strings.Trim(value, "/")
+		case "url":
+			moduleURL = value
+		}
+	}
+	flush()
+
+	return urls
+}
+
+// resolveSubmoduleURL converts the relative submodule url (starts with "./"
+// or "../") to an absolute one, based on the parent repository.
+func resolveSubmoduleURL(parent *types.Repository, url string) string {
+	if !strings.HasPrefix(url, "./") && !strings.HasPrefix(url, "../") {
+		return url
+	}
+	repoPath := path.Join("/", parent.Path(), url)
+	return fmt.Sprintf("https://%s%s", parent.Domain, repoPath)
+}
+
+// newSubmoduleNode creates the node for a submodule entry. The submodule
+// repository is mounted at its pinned commit with a nested provider. If it
+// can never be loaded, the submodule is shown as an empty directory. Other
+// errors are returned, so that it is loaded again by the next lookup.
+func (n *Node) newSubmoduleNode(ctx context.Context, ent *types.Entry) (*Node, error) {
+	shared, err := n.shared.loadSubmodule(ctx, ent)
+	switch {
+	case errors.Is(err, errBadSubmodule):
+		n.logger.Warnf("Load submodule %q error: %v, show it as an empty directory", ent.Path, err)
+		return newNode(ent, n.shared), nil
+	case err != nil:
+		return nil, err
+	}
+
+	root := &types.Entry{
+		Name:   ent.Name,
+		IsDir:  true,
+		Mode:   ent.Mode,
+		SHA:    ent.SHA,
+		WebUrl: ent.WebUrl,
+	}
+	return newNode(root, shared), nil
+}
+
+func (s *nodeShared) loadSubmodule(ctx context.Context, ent *types.Entry) (*nodeShared, error) {
+	if ent.Submodule.Commit == "" {
+		return nil, fmt.Errorf("%w: the commit is empty", errBadSubmodule)
+	}
+	state := s.current()
+	url := ent.Submodule.URL
+	if url == "" {
+		// The ".gitmodules" might fail to read when listing, try again.
+		var err error
+		url, err = state.submodules.getURL(ctx, ent.Path)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", gitmodulesPath, err)
+		}
+		if url == "" {
+			return nil, fmt.Errorf("%w: could not find url in %s", errBadSubmodule, gitmodulesPath)
+		}
+	}
+
+	url = resolveSubmoduleURL(state.repo, url)
+	repo, err := types.ParseRepository(url)
+	if err != nil {
+		return nil, fmt.Errorf("%w: parse url %q: %v", errBadSubmodule, url, err)
+	}
+	repo.Ref = ent.Submodule.Commit
+	repo.Commit = ent.Submodule.Commit
+
+	prov, err := s.loadProvider(repo)
+	if err != nil {
+		return nil, fmt.Errorf("%w: load provider: %v", errBadSubmodule, err)
+	}
+	err = prov.Check(ctx)
+	if errors.Is(err, types.ErrNotFound) {
+		return nil, fmt.Errorf("%w: check repository: %v", errBadSubmodule, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("check repository: %w", err)
+	}
+
+	logrus.Infof("Load submodule %q as %s", ent.Path, repo.String())
+	return s.withRepo(repo, prov, path.Join(s.prefix, ent.Path)), nil
+}
@@ -0,0 +1,193 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/fioncat/grfs/types"
+)
+
+const testGitmodules = `
+[submodule "vendor/lib"]
+	path = vendor/lib
+	url = https://github.com/fioncat/lib.git
+[submodule "tools"]
+	path = tools/
+	url = ../tools.git
+# comment
+[submodule "broken"]
+	path = broken
+`
+
+func TestParseGitmodules(t *testing.T) {
+	urls := parseGitmodules([]byte(testGitmodules))
+	expect := map[string]string{
+		"vendor/lib": "https://github.com/fioncat/lib.git",
+		"tools":      "../tools.git",
+	}
+	if !reflect.DeepEqual(urls, expect) {
+		t.Fatalf("Unexpect submodule urls %v, expect %v", urls, expect)
+	}
+}
+
+func TestResolveSubmoduleURL(t *testing.T) {
+	parent := &types.Repository{
+		Domain: "my-gitlab.com",
+		Owner:  "k8s/devops",
+		Name:   "etcdhelper",
+	}
+	testCases := []struct {
+		url    string
+		expect string
+	}{
+		{"https://github.com/fioncat/lib.git", "https://github.com/fioncat/lib.git"},
+		{"git@github.com:fioncat/lib.git", "git@github.com:fioncat/lib.git"},
+		{"../tools.git", "https://my-gitlab.com/k8s/devops/tools.git"},
+		{"../../common/tools", "https://my-gitlab.com/k8s/common/tools"},
+		{"./sub", "https://my-gitlab.com/k8s/devops/etcdhelper/sub"},
+	}
+
+	for i, tc := range testCases {
+		url := resolveSubmoduleURL(parent, tc.url)
+		if url != tc.expect {
+			t.Fatalf("Unexpect resolved url %q, expect %q, index %d", url, tc.expect, i)
+		}
+	}
+}
+
+func TestLoadSubmodule(t *testing.T) {
+	p := &testProvider{ents: []*testEntry{
+		{
+			info: &types.Entry{Path: ".gitmodules", Name: ".gitmodules"},
+			data: []byte(testGitmodules),
+		},
+	}}
+	root := NewNode(&types.Repository{
+		Domain: "github.com",
+		Owner:  "fioncat",
+		Name:   "grfs",
+	}, p, nil, &types.Config{Fs: &types.FilesystemConfig{}})
+
+	var loaded *types.Repository
+	root.shared.loadProvider = func(repo *types.Repository) (types.Provider, error) {
+		if repo.Name == "tools" {
+			return nil, errors.New("no permission")
+		}
+		loaded = repo
+		return &testProvider{}, nil
+	}
+
+	ents := []*types.Entry{
+		{
+			Path:      "vendor/lib",
+			Name:      "lib",
+			IsDir:     true,
+			Submodule: &types.Submodule{Commit: "abc"},
+		},
+		{
+			Path:      "tools",
+			Name:      "tools",
+			IsDir:     true,
+			Submodule: &types.Submodule{Commit: "def"},
+		},
+	}
+	root.shared.current().submodules.fill(context.Background(), ents)
+
+	n, err := root.newSubmoduleNode(context.Background(), ents[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.shared == root.shared {
+		t.Fatal("Expect submodule to be loaded with its own provider")
+	}
+	if n.shared.prefix != "vendor/lib" || n.entry.Path != "" {
+		t.Fatalf("Unexpect submodule prefix %q and path %q", n.shared.prefix, n.entry.Path)
+	}
+	expect := &types.Repository{
+		Domain: "github.com",
+		Owner:  "fioncat",
+		Name:   "lib",
+		Ref:    "abc",
+		Commit: "abc",
+	}
+	if !reflect.DeepEqual(loaded, expect) {
+		t.Fatalf("Unexpect submodule repo %+v, expect %+v", loaded, expect)
+	}
+	if n.shared.getIno(n.entry) != root.shared.getIno(ents[0]) {
+		t.Fatal("Expect submodule root to have the same ino as its entry")
+	}
+
+	n, err = root.newSubmoduleNode(context.Background(), ents[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.shared != root.shared || n.entry.Submodule == nil {
+		t.Fatal("Expect failed submodule to be an empty directory")
+	}
+	if n.entry.Submodule.URL != "../tools.git" {
+		t.Fatalf("Unexpect submodule url %q", n.entry.Submodule.URL)
+	}
+}
+
+type testCheckProvider struct {
+	testProvider
+
+	err error
+}
+
+func (p *testCheckProvider) Check(ctx context.Context) error { return p.err }
+
+func TestLoadSubmoduleRetry(t *testing.T) {
+	p := &testProvider{ents: []*testEntry{
+		{
+			info: &types.Entry{Path: ".gitmodules", Name: ".gitmodules"},
+			data: []byte(testGitmodules),
+		},
+	}}
+	root := NewNode(&types.Repository{
+		Domain: "github.com",
+		Owner:  "fioncat",
+		Name:   "grfs",
+	}, p, nil, &types.Config{Fs: &types.FilesystemConfig{}})
+
+	var checkErr error
+	root.shared.loadProvider = func(repo *types.Repository) (types.Provider, error) {
+		return &testCheckProvider{err: checkErr}, nil
+	}
+	ent := &types.Entry{
+		Path:      "vendor/lib",
+		Name:      "lib",
+		IsDir:     true,
+		Submodule: &types.Submodule{Commit: "abc"},
+	}
+	ctx := context.Background()
+
+	// The transient errors are returned, rather than showing the submodule
+	// as an empty directory forever.
+	checkErr = errors.New("connection reset")
+	_, err := root.newSubmoduleNode(ctx, ent)
+	if err == nil || errors.Is(err, errBadSubmodule) {
+		t.Fatalf("Expect transient error, got %v", err)
+	}
+
+	checkErr = nil
+	n, err := root.newSubmoduleNode(ctx, ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.shared == root.shared {
+		t.Fatal("Expect submodule to be loaded by the next lookup")
+	}
+
+	checkErr = fmt.Errorf("get repository: %w", types.ErrNotFound)
+	n, err = root.newSubmoduleNode(ctx, ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.shared != root.shared || n.entry.Submodule == nil {
+		t.Fatal("Expect not found submodule to be an empty directory")
+	}
+}
@@ -0,0 +1,241 @@
+package fs
+
+import (
+	"context"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/fioncat/grfs/types"
+	"github.com/sirupsen/logrus"
+)
+
+// treeIndex holds the whole repository tree loaded by one request, the
+// directory listings are served from it. If the provider cannot load the
+// tree, or the tree is truncated, nodes fallback to reading directories one
+// by one. A failed load is retried after backoff.
+type treeIndex struct {
+	reader types.TreeReader
+	// sizer is not nil if the tree leaves the sizes of files unknown, they
+	// are read when the directories are listed.
+	sizer   types.SizeReader
+	repo    *types.Repository
+	ttl     time.Duration
+	timeout time.Duration
+
+	dirs     map[string][]*types.Entry
+	loadTime time.Time
+	loaded   bool
+
+	// sized holds the directories whose sizes are read, and sizing holds the
+	// channels of the running reads. They are replaced with dirs.
+	sized  map[string]bool
+	sizing map[string]chan struct{}
+
+	// loading is closed when the running load is done, nil if no load is
+	// running. The listings wait for it for at most treeLoadWait, and then
+	// read from provider directly.
+	loading chan struct{}
+
+	failures  int
+	retryTime time.Time
+
+	mu sync.Mutex
+}
+
+const (
+	treeRetryMinBackoff = time.Second * 10
+	treeRetryMaxBackoff = time.Minute * 10
+
+	// treeLoadWait is the max time for a listing to wait for the tree, a
+	// large tree might take minutes to load.
+	treeLoadWait = time.Second * 3
+)
+
+func newTreeIndex(provider types.Provider, repo *types.Repository, cfg *types.FilesystemConfig) *treeIndex {
+	if cfg.DisableTreePrefetch {
+		return nil
+	}
+	reader, ok := provider.(types.TreeReader)
+	if !ok {
+		return nil
+	}
+	sizer, _ := provider.(types.SizeReader)
+	return &treeIndex{
+		reader:  reader,
+		sizer:   sizer,
+		repo:    repo,
+		ttl:     cfg.DirCacheTTL,
+		timeout: cfg.ReadTreeTimeout,
+	}
+}
+
+// readDir returns the sub entries of a directory from the tree. The ok is
+// false if the tree is not available, the caller should read the directory
+// from provider instead.
+func (t *treeIndex) readDir(ctx context.Context, dir string) ([]*types.Entry, bool) {
+	if t == nil {
+		return nil, false
+	}
+
+	t.mu.Lock()
+	if (!t.loaded || t.expired()) && t.loading == nil && !time.Now().Before(t.retryTime) {
+		t.startLoad()
+	}
+	if loading := t.loading; loading != nil {
+		t.mu.Unlock()
+		timer := time.NewTimer(treeLoadWait)
+		select {
+		case <-loading:
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+		t.mu.Lock()
+	}
+
+	if !t.loaded || t.expired() || t.dirs == nil {
+		t.mu.Unlock()
+		return nil, false
+	}
+
+	ents, ok := t.dirs[dir]
+	if !ok {
+		t.mu.Unlock()
+		return nil, false
+	}
+	sized, sizing := t.sized, t.sizing
+	t.mu.Unlock()
+
+	err := t.fillSizes(ctx, dir, ents, sized, sizing)
+	if err != nil {
+		logrus.Warnf("Read sizes for dir %q error: %v, fallback to read it from provider", dir, err)
+		return nil, false
+	}
+
+	// Return a copy, the caller might sort it.
+	result := make([]*types.Entry, len(ents))
+	copy(result, ents)
+	return result, true
+}
+
+// fillSizes reads the sizes of a directory in the tree once, the concurrent
+// listings wait for the running read. A failed read is tried again by the
+// next listing.
+func (t *treeIndex) fillSizes(ctx context.Context, dir string, ents []*types.Entry,
+	sized map[string]bool, sizing map[string]chan struct{}) error {
+	if t.sizer == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	for !sized[dir] {
+		loading, ok := sizing[dir]
+		if !ok {
+			break
+		}
+		t.mu.Unlock()
+		select {
+		case <-loading:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		t.mu.Lock()
+	}
+	if sized[dir] {
+		t.mu.Unlock()
+		return nil
+	}
+	loading := make(chan struct{})
+	sizing[dir] = loading
+	t.mu.Unlock()
+
+	err := t.sizer.ReadSizes(ctx, ents)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(sizing, dir)
+	if err == nil {
+		sized[dir] = true
+	}
+	close(loading)
+	return err
+}
+
+// startLoad loads the tree in background. It is not bound to the context of
+// any listing, so that an interrupted listing does not waste the request.
+func (t *treeIndex) startLoad() {
+	loading := make(chan struct{})
+	t.loading = loading
+	go func() {
+		ctx, cancel := withTimeout(context.Background(), t.timeout)
+		defer cancel()
+		dirs, err := t.load(ctx)
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.finishLoad(dirs, err)
+		t.loading = nil
+		close(loading)
+	}()
+}
+
+func (t *treeIndex) expired() bool {
+	if t.repo.IsPinned() || t.ttl <= 0 {
+		return false
+	}
+	return time.Since(t.loadTime) > t.ttl
+}
+
+// load reads the tree from provider and groups the entries by directory, the
+// dirs is nil if the tree is truncated.
+func (t *treeIndex) load(ctx context.Context) (map[string][]*types.Entry, error) {
+	start := time.Now()
+	ents, truncated, err := t.reader.ReadTree(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if truncated {
+		logrus.Info("The repository tree is truncated, fallback to read directories one by one")
+		return nil, nil
+	}
+
+	dirs := map[string][]*types.Entry{"": {}}
+	for _, ent := range ents {
+		parent := path.Dir(ent.Path)
+		if parent == "." {
+			parent = ""
+		}
+		dirs[parent] = append(dirs[parent], ent)
+		if ent.IsDir {
+			if _, ok := dirs[ent.Path]; !ok {
+				dirs[ent.Path] = []*types.Entry{}
+			}
+		}
+	}
+	logrus.Infof("Load repository tree done, with %d entries in %d directories, took %v",
+		len(ents), len(dirs), time.Since(start))
+	return dirs, nil
+}
+
+func (t *treeIndex) finishLoad(dirs map[string][]*types.Entry, err error) {
+	if err != nil {
+		t.loaded, t.dirs = false, nil
+		t.failures++
+		backoff := treeRetryMaxBackoff
+		if t.failures < 32 {
+			if d := treeRetryMinBackoff << (t.failures - 1); d > 0 && d < backoff {
+				backoff = d
+			}
+		}
+		t.retryTime = time.Now().Add(backoff)
+		logrus.Warnf("Read repository tree error: %v, fallback to read directories one by one, retry after %v",
+			err, backoff)
+		return
+	}
+
+	t.loaded, t.loadTime = true, time.Now()
+	t.dirs = dirs
+	t.sized, t.sizing = make(map[string]bool), make(map[string]chan struct{})
+	t.failures, t.retryTime = 0, time.Time{}
+}
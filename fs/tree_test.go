@@ -0,0 +1,242 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fioncat/grfs/types"
+)
+
+type testTreeProvider struct {
+	testProvider
+
+	tree      []*types.Entry
+	truncated bool
+	err       error
+	reads     atomic.Int32
+
+	// block makes ReadTree wait until it is closed.
+	block chan struct{}
+}
+
+func (p *testTreeProvider) ReadTree(ctx context.Context) ([]*types.Entry, bool, error) {
+	p.reads.Add(1)
+	if p.block != nil {
+		select {
+		case <-p.block:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+	if p.err != nil {
+		return nil, false, p.err
+	}
+	return p.tree, p.truncated, nil
+}
+
+func TestTreeIndex(t *testing.T) {
+	p := &testTreeProvider{
+		tree: []*types.Entry{
+			{Path: "README.md", Name: "README.md"},
+			{Path: "src", Name: "src", IsDir: true},
+			{Path: "src/main.go", Name: "main.go"},
+			{Path: "src/pkg", Name: "pkg", IsDir: true},
+			{Path: "src/pkg/util.go", Name: "util.go"},
+			{Path: "src/empty", Name: "empty", IsDir: true},
+		},
+	}
+	cfg := &types.FilesystemConfig{}
+	tree := newTreeIndex(p, &types.Repository{Commit: "abc"}, cfg)
+
+	testCases := []struct {
+		dir   string
+		names []string
+	}{
+		{"", []string{"README.md", "src"}},
+		{"src", []string{"main.go", "pkg", "empty"}},
+		{"src/pkg", []string{"util.go"}},
+		{"src/empty", []string{}},
+	}
+	for _, tc := range testCases {
+		ents, ok := tree.readDir(context.Background(), tc.dir)
+		if !ok {
+			t.Fatalf("Expect dir %q in tree", tc.dir)
+		}
+		if len(ents) != len(tc.names) {
+			t.Fatalf("Unexpect entries count %d for %q, expect %d", len(ents), tc.dir, len(tc.names))
+		}
+		for i, ent := range ents {
+			if ent.Name != tc.names[i] {
+				t.Fatalf("Unexpect entry %q in %q, expect %q", ent.Name, tc.dir, tc.names[i])
+			}
+		}
+	}
+
+	_, ok := tree.readDir(context.Background(), "not-exists")
+	if ok {
+		t.Fatal("Expect not exists dir fallback")
+	}
+	if p.reads.Load() != 1 {
+		t.Fatalf("Expect tree to be read once, read %d", p.reads.Load())
+	}
+
+	p.truncated = true
+	tree = newTreeIndex(p, &types.Repository{Commit: "abc"}, cfg)
+	_, ok = tree.readDir(context.Background(), "")
+	if ok {
+		t.Fatal("Expect truncated tree fallback")
+	}
+
+	cfg.DisableTreePrefetch = true
+	tree = newTreeIndex(p, &types.Repository{Commit: "abc"}, cfg)
+	if tree != nil {
+		t.Fatal("Expect tree index to be disabled")
+	}
+}
+
+func TestTreeIndexRetry(t *testing.T) {
+	p := &testTreeProvider{
+		tree: []*types.Entry{{Path: "README.md", Name: "README.md"}},
+		err:  errors.New("server error"),
+	}
+	tree := newTreeIndex(p, &types.Repository{Commit: "abc"}, &types.FilesystemConfig{})
+
+	_, ok := tree.readDir(context.Background(), "")
+	if ok {
+		t.Fatal("Expect failed tree fallback")
+	}
+	// Do not retry before backoff.
+	_, ok = tree.readDir(context.Background(), "")
+	if ok || p.reads.Load() != 1 {
+		t.Fatalf("Expect no retry before backoff, read %d", p.reads.Load())
+	}
+	if backoff := time.Until(tree.retryTime); backoff <= 0 || backoff > treeRetryMinBackoff {
+		t.Fatalf("Unexpect retry backoff %v", backoff)
+	}
+
+	p.err = nil
+	tree.retryTime = time.Now()
+	ents, ok := tree.readDir(context.Background(), "")
+	if !ok || len(ents) != 1 {
+		t.Fatalf("Expect tree to be loaded after retry, got %v", ents)
+	}
+	if p.reads.Load() != 2 {
+		t.Fatalf("Expect tree to be read twice, read %d", p.reads.Load())
+	}
+}
+
+func TestTreeIndexLoading(t *testing.T) {
+	p := &testTreeProvider{
+		tree:  []*types.Entry{{Path: "README.md", Name: "README.md"}},
+		block: make(chan struct{}),
+	}
+	tree := newTreeIndex(p, &types.Repository{Commit: "abc"}, &types.FilesystemConfig{})
+
+	// The listing stops waiting once interrupted, but the load goes on.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	start := time.Now()
+	_, ok := tree.readDir(ctx, "")
+	if ok {
+		t.Fatal("Expect fallback for interrupted listing")
+	}
+	if elapsed := time.Since(start); elapsed >= treeLoadWait {
+		t.Fatalf("Expect interrupted listing to return, took %v", elapsed)
+	}
+
+	done := make(chan bool)
+	go func() {
+		_, ok := tree.readDir(context.Background(), "")
+		done <- ok
+	}()
+	close(p.block)
+	if !<-done {
+		t.Fatal("Expect the waiting listing to read the tree")
+	}
+	if p.reads.Load() != 1 {
+		t.Fatalf("Expect tree to be read once, read %d", p.reads.Load())
+	}
+}
+
+func TestTreeIndexTimeout(t *testing.T) {
+	p := &testTreeProvider{
+		tree:  []*types.Entry{{Path: "README.md", Name: "README.md"}},
+		block: make(chan struct{}),
+	}
+	tree := newTreeIndex(p, &types.Repository{Commit: "abc"}, &types.FilesystemConfig{
+		ReadTreeTimeout: time.Millisecond * 20,
+	})
+
+	_, ok := tree.readDir(context.Background(), "")
+	if ok {
+		t.Fatal("Expect fallback when loading tree timeout")
+	}
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	if tree.loading != nil || tree.failures != 1 || !tree.retryTime.After(time.Now()) {
+		t.Fatalf("Expect the timeout load to be retried after backoff, failures %d", tree.failures)
+	}
+}
+
+type testSizeTreeProvider struct {
+	testTreeProvider
+
+	sizes map[string]int64
+	dirs  []int
+	err   error
+}
+
+func (p *testSizeTreeProvider) ReadSizes(ctx context.Context, ents []*types.Entry) error {
+	p.dirs = append(p.dirs, len(ents))
+	if p.err != nil {
+		return p.err
+	}
+	for _, ent := range ents {
+		if !ent.IsDir {
+			ent.Size = p.sizes[ent.Path]
+		}
+	}
+	return nil
+}
+
+func TestTreeIndexSizes(t *testing.T) {
+	p := &testSizeTreeProvider{
+		testTreeProvider: testTreeProvider{
+			tree: []*types.Entry{
+				{Path: "README.md", Name: "README.md"},
+				{Path: "src", Name: "src", IsDir: true},
+				{Path: "src/main.go", Name: "main.go"},
+			},
+		},
+		sizes: map[string]int64{"README.md": 10, "src/main.go": 20},
+		err:   errors.New("server error"),
+	}
+	tree := newTreeIndex(p, &types.Repository{Commit: "abc"}, &types.FilesystemConfig{})
+
+	// The failed read falls back to the provider, and is tried again.
+	_, ok := tree.readDir(context.Background(), "")
+	if ok {
+		t.Fatal("Expect fallback when failed to read sizes")
+	}
+	p.err = nil
+
+	for i := 0; i < 2; i++ {
+		ents, ok := tree.readDir(context.Background(), "")
+		if !ok {
+			t.Fatal("Expect root dir in tree")
+		}
+		if ents[0].Size != 10 {
+			t.Fatalf("Unexpect size %d for %q", ents[0].Size, ents[0].Path)
+		}
+	}
+	// Only the listed directories are read, once.
+	if len(p.dirs) != 2 {
+		t.Fatalf("Expect sizes to be read twice, got %v", p.dirs)
+	}
+	if p.tree[2].Size != 0 {
+		t.Fatal("Expect sizes of the unlisted dir not to be read")
+	}
+}
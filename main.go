@@ -64,6 +64,8 @@ func main() {
 	rootCmd.AddCommand(cmd.Unmount())
 	rootCmd.AddCommand(cmd.Get())
 	rootCmd.AddCommand(cmd.Logs())
+	rootCmd.AddCommand(cmd.Checkout())
+	rootCmd.AddCommand(cmd.Ctl())
 
 	rootCmd.AddCommand(versionCmd)
 
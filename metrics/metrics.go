@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+const namespace = "grfs"
+
+var (
+	providerCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "provider_calls_total",
+		Help:      "The number of provider calls, by provider type, method and result.",
+	}, []string{"provider", "method", "result"})
+
+	providerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "provider_call_duration_seconds",
+		Help:      "The latency of provider calls, by provider type and method.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"provider", "method"})
+
+	fuseOps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "fuse_operations_total",
+		Help:      "The number of FUSE operations, by opcode and result.",
+	}, []string{"op", "result"})
+
+	fuseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "fuse_operation_duration_seconds",
+		Help:      "The latency of FUSE operations, by opcode.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"op"})
+
+	downloadBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "download_bytes_total",
+		Help:      "The bytes of file content downloaded from providers.",
+	})
+
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "The number of cache lookups, by cache and result.",
+	}, []string{"cache", "result"})
+
+	bufferBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "buffer_bytes",
+		Help:      "The memory held by file content buffers.",
+	})
+)
+
+// newRegistry returns the registry of all metrics, with labels added to them.
+func newRegistry(labels prometheus.Labels) (*prometheus.Registry, error) {
+	registry := prometheus.NewRegistry()
+	registerer := prometheus.WrapRegistererWith(labels, registry)
+	for _, collector := range []prometheus.Collector{
+		providerCalls, providerDuration,
+		fuseOps, fuseDuration,
+		downloadBytes, cacheRequests, bufferBytes,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	} {
+		err := registerer.Register(collector)
+		if err != nil {
+			return nil, fmt.Errorf("register metrics: %w", err)
+		}
+	}
+	return registry, nil
+}
+
+// ObserveProviderCall records a provider call started at start. It is
+// designed to be deferred with a pointer to the named error result.
+func ObserveProviderCall(provider, method string, start time.Time, err *error) {
+	result := "ok"
+	if *err != nil {
+		result = "error"
+	}
+	providerCalls.WithLabelValues(provider, method, result).Inc()
+	providerDuration.WithLabelValues(provider, method).Observe(time.Since(start).Seconds())
+}
+
+// ObserveFuseOp records a FUSE operation started at start.
+func ObserveFuseOp(op string, start time.Time, ok bool) {
+	result := "ok"
+	if !ok {
+		result = "error"
+	}
+	fuseOps.WithLabelValues(op, result).Inc()
+	fuseDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+func AddDownloadBytes(n int) {
+	downloadBytes.Add(float64(n))
+}
+
+// ObserveCache records a lookup of cache, such as "blob" or "chunk".
+func ObserveCache(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheRequests.WithLabelValues(cache, result).Inc()
+}
+
+func SetBufferBytes(n int64) {
+	bufferBytes.Set(float64(n))
+}
+
+// Serve starts the metrics listener on addr in background. The labels are
+// added to all metrics to tell the daemons apart, such as the repository. The
+// Addr of the returned server is the listened address, which is useful when
+// the port in addr is 0.
+func Serve(addr string, labels map[string]string) (*http.Server, error) {
+	registry, err := newRegistry(labels)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen metrics address: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	server := &http.Server{
+		Addr:    listener.Addr().String(),
+		Handler: mux,
+	}
+
+	go func() {
+		logrus.Infof("Serve metrics on %q", server.Addr)
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Errorf("Serve metrics error: %v", err)
+		}
+	}()
+	return server, nil
+}
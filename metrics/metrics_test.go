@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	ObserveCache("blob", true)
+	ObserveCache("blob", true)
+	ObserveCache("blob", false)
+	if v := testutil.ToFloat64(cacheRequests.WithLabelValues("blob", "hit")); v != 2 {
+		t.Fatalf("Unexpect cache hits %v", v)
+	}
+	if v := testutil.ToFloat64(cacheRequests.WithLabelValues("blob", "miss")); v != 1 {
+		t.Fatalf("Unexpect cache misses %v", v)
+	}
+
+	err := errors.New("test error")
+	ObserveProviderCall("github", "ReadFile", time.Now(), &err)
+	err = nil
+	ObserveProviderCall("github", "ReadFile", time.Now(), &err)
+	if v := testutil.ToFloat64(providerCalls.WithLabelValues("github", "ReadFile", "error")); v != 1 {
+		t.Fatalf("Unexpect error calls %v", v)
+	}
+	if v := testutil.ToFloat64(providerCalls.WithLabelValues("github", "ReadFile", "ok")); v != 1 {
+		t.Fatalf("Unexpect ok calls %v", v)
+	}
+
+	SetBufferBytes(1024)
+	if v := testutil.ToFloat64(bufferBytes); v != 1024 {
+		t.Fatalf("Unexpect buffer bytes %v", v)
+	}
+
+}
+
+func TestServe(t *testing.T) {
+	ObserveCache("chunk", true)
+
+	// Each daemon serves its own metrics, with the port chosen by system.
+	for _, repo := range []string{"github.com:fioncat/grfs", "github.com:fioncat/roxide"} {
+		server, err := Serve("127.0.0.1:0", map[string]string{"repo": repo})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+
+		resp, err := http.Get(fmt.Sprintf("http://%s/metrics", server.Addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := fmt.Sprintf(`grfs_cache_requests_total{cache="chunk",repo=%q,result="hit"}`, repo)
+		if !strings.Contains(string(data), expect) {
+			t.Fatalf("Expect %s in metrics:\n%s", expect, data)
+		}
+	}
+}
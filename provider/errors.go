@@ -0,0 +1,101 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/fioncat/grfs/metrics"
+	"github.com/fioncat/grfs/types"
+	"github.com/google/go-github/v56/github"
+	"github.com/xanzy/go-gitlab"
+)
+
+// finishCall is deferred by the provider calls with a pointer to the named
+// error result. It converts the error to the typed errors and records the
+// metrics of the call.
+func finishCall(provider, method string, start time.Time, err *error) {
+	*err = convertError(*err)
+	metrics.ObserveProviderCall(provider, method, start, err)
+}
+
+// convertError wraps err with the typed error in types, which is decided by
+// the cause, such as the status code of the API response.
+func convertError(err error) error {
+	if err == nil {
+		return nil
+	}
+	kind := getErrorKind(err)
+	if kind == nil || errors.Is(err, kind) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", kind, err)
+}
+
+func getErrorKind(err error) error {
+	var githubRateErr *github.RateLimitError
+	var githubAbuseErr *github.AbuseRateLimitError
+	if errors.As(err, &githubRateErr) || errors.As(err, &githubAbuseErr) {
+		return types.ErrRateLimited
+	}
+
+	var githubErr *github.ErrorResponse
+	if errors.As(err, &githubErr) {
+		for _, e := range githubErr.Errors {
+			if e.Code == "too_large" {
+				return types.ErrTooLarge
+			}
+		}
+		if githubErr.Response != nil {
+			return getStatusErrorKind(githubErr.Response.StatusCode)
+		}
+	}
+
+	var gitlabErr *gitlab.ErrorResponse
+	if errors.As(err, &gitlabErr) && gitlabErr.Response != nil {
+		return getStatusErrorKind(gitlabErr.Response.StatusCode)
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return types.ErrTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return types.ErrTimeout
+	}
+	return nil
+}
+
+func getStatusErrorKind(code int) error {
+	switch code {
+	case http.StatusNotFound:
+		return types.ErrNotFound
+	case http.StatusUnauthorized:
+		return types.ErrUnauthorized
+	case http.StatusForbidden:
+		return types.ErrForbidden
+	case http.StatusTooManyRequests:
+		return types.ErrRateLimited
+	case http.StatusRequestEntityTooLarge:
+		return types.ErrTooLarge
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return types.ErrTimeout
+	}
+	return nil
+}
+
+// checkStatus returns the typed error for the failed response, which is not
+// reported as an error by the API client.
+func checkStatus(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err := fmt.Errorf("unexpected status %s", resp.Status)
+	if kind := getStatusErrorKind(resp.StatusCode); kind != nil {
+		return fmt.Errorf("%w: %w", kind, err)
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/fioncat/grfs/types"
+	"github.com/google/go-github/v56/github"
+	"github.com/xanzy/go-gitlab"
+)
+
+func newGithubError(code int, errs ...github.Error) error {
+	return &github.ErrorResponse{
+		Response: &http.Response{StatusCode: code, Request: &http.Request{}},
+		Message:  http.StatusText(code),
+		Errors:   errs,
+	}
+}
+
+func newGitlabError(code int) error {
+	return &gitlab.ErrorResponse{
+		Response: &http.Response{StatusCode: code, Request: &http.Request{}},
+		Message:  http.StatusText(code),
+	}
+}
+
+func TestConvertError(t *testing.T) {
+	testCases := []struct {
+		name string
+		err  error
+		kind error
+	}{
+		{"github not found", newGithubError(http.StatusNotFound), types.ErrNotFound},
+		{"github unauthorized", newGithubError(http.StatusUnauthorized), types.ErrUnauthorized},
+		{"github forbidden", newGithubError(http.StatusForbidden), types.ErrForbidden},
+		{"github too large", newGithubError(http.StatusRequestEntityTooLarge), types.ErrTooLarge},
+		{"github too large code", newGithubError(http.StatusForbidden, github.Error{Code: "too_large"}), types.ErrTooLarge},
+		{"github too many requests", newGithubError(http.StatusTooManyRequests), types.ErrRateLimited},
+		{"github rate limit", &github.RateLimitError{Response: &http.Response{}}, types.ErrRateLimited},
+		{"github abuse rate limit", &github.AbuseRateLimitError{Response: &http.Response{}}, types.ErrRateLimited},
+		{"github server error", newGithubError(http.StatusInternalServerError), nil},
+		{"gitlab not found", newGitlabError(http.StatusNotFound), types.ErrNotFound},
+		{"gitlab unauthorized", newGitlabError(http.StatusUnauthorized), types.ErrUnauthorized},
+		{"gitlab forbidden", newGitlabError(http.StatusForbidden), types.ErrForbidden},
+		{"gitlab too large", newGitlabError(http.StatusRequestEntityTooLarge), types.ErrTooLarge},
+		{"gitlab too many requests", newGitlabError(http.StatusTooManyRequests), types.ErrRateLimited},
+		{"gitlab gateway timeout", newGitlabError(http.StatusGatewayTimeout), types.ErrTimeout},
+		{"wrapped", fmt.Errorf("github get repository: %w", newGithubError(http.StatusNotFound)), types.ErrNotFound},
+		{"deadline", context.DeadlineExceeded, types.ErrTimeout},
+		{"net timeout", fmt.Errorf("dial: %w", testTimeoutError{}), types.ErrTimeout},
+		{"unknown", errors.New("unknown error"), nil},
+	}
+
+	kinds := []error{
+		types.ErrNotFound, types.ErrUnauthorized, types.ErrForbidden,
+		types.ErrRateLimited, types.ErrTooLarge, types.ErrTimeout,
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if kind := getErrorKind(testCase.err); kind != testCase.kind {
+				t.Fatalf("Expect kind %v, got %v", testCase.kind, kind)
+			}
+
+			err := convertError(testCase.err)
+			if !errors.Is(err, testCase.err) {
+				t.Fatalf("Expect converted error %v to keep the cause", err)
+			}
+			for _, kind := range kinds {
+				if errors.Is(err, kind) != (kind == testCase.kind) {
+					t.Fatalf("Unexpect kind %v of converted error %v", kind, err)
+				}
+			}
+		})
+	}
+
+	if convertError(nil) != nil {
+		t.Fatal("Expect nil error to be kept")
+	}
+	// The typed error should not be wrapped twice.
+	err := fmt.Errorf("%w: in blob", types.ErrNotFound)
+	if convertError(err) != err {
+		t.Fatal("Expect typed error to be kept")
+	}
+}
+
+func TestCheckStatus(t *testing.T) {
+	testCases := []struct {
+		status int
+		ok     bool
+		kind   error
+	}{
+		{http.StatusOK, true, nil},
+		{http.StatusPartialContent, true, nil},
+		{http.StatusNotFound, false, types.ErrNotFound},
+		{http.StatusUnauthorized, false, types.ErrUnauthorized},
+		{http.StatusForbidden, false, types.ErrForbidden},
+		{http.StatusRequestEntityTooLarge, false, types.ErrTooLarge},
+		{http.StatusTooManyRequests, false, types.ErrRateLimited},
+		{http.StatusRequestTimeout, false, types.ErrTimeout},
+		{http.StatusBadGateway, false, nil},
+	}
+	for _, testCase := range testCases {
+		resp := &http.Response{
+			StatusCode: testCase.status,
+			Status:     fmt.Sprintf("%d %s", testCase.status, http.StatusText(testCase.status)),
+		}
+		err := checkStatus(resp)
+		if testCase.ok {
+			if err != nil {
+				t.Fatalf("Expect no error for status %d, got %v", testCase.status, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Fatalf("Expect error for status %d", testCase.status)
+		}
+		if testCase.kind != nil && !errors.Is(err, testCase.kind) {
+			t.Fatalf("Expect %v for status %d, got %v", testCase.kind, testCase.status, err)
+		}
+		if testCase.kind == nil && getErrorKind(err) != nil {
+			t.Fatalf("Expect untyped error for status %d, got %v", testCase.status, err)
+		}
+	}
+}
@@ -1,42 +1,88 @@
 package provider
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
+	pathpkg "path"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/fioncat/grfs/types"
 	"github.com/google/go-github/v56/github"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
 )
 
+const githubMaxPerPage = 100
+
+// githubTreeMaxRequests is the max number of requests sent to read a
+// truncated tree by directories.
+const githubTreeMaxRequests = 200
+
+const githubGraphQLURL = "https://api.github.com/graphql"
+
+// githubGraphQLBatch is the max number of paths queried in one GraphQL
+// request.
+const githubGraphQLBatch = 100
+
 type githubProvider struct {
 	repo *types.Repository
 
 	client *github.Client
+
+	limiter *rateLimiter
+
+	// graphqlURL is set if the token is provided, which is required by the
+	// GraphQL API.
+	graphqlURL string
 }
 
-func newGithub(repo *types.Repository, token string) types.Provider {
-	var httpCli *http.Client
-	ctx := context.Background()
+func newGithub(repo *types.Repository, token string, limiter *rateLimiter, retryCfg *types.RetryConfig) types.Provider {
+	transport := http.DefaultTransport
 	if token != "" {
-		ts := oauth2.StaticTokenSource(&oauth2.Token{
-			AccessToken: token,
-		})
-		httpCli = oauth2.NewClient(ctx, ts)
+		transport = &oauth2.Transport{
+			Source: oauth2.StaticTokenSource(&oauth2.Token{
+				AccessToken: token,
+			}),
+			Base: transport,
+		}
+	}
+	httpCli := &http.Client{
+		Transport: &retryTransport{
+			cfg: retryCfg,
+			base: &rateLimitTransport{
+				limiter:     limiter,
+				base:        transport,
+				hideHeaders: true,
+			},
+		},
 	}
 
 	client := github.NewClient(httpCli)
 
-	return &githubProvider{
-		repo:   repo,
-		client: client,
+	p := &githubProvider{
+		repo:    repo,
+		client:  client,
+		limiter: limiter,
 	}
+	if token != "" {
+		p.graphqlURL = githubGraphQLURL
+	}
+	return p
 }
 
-func (p *githubProvider) Check(ctx context.Context) error {
+func (p *githubProvider) RateLimit() *types.RateLimit {
+	return p.limiter.RateLimit()
+}
+
+func (p *githubProvider) Check(ctx context.Context) (err error) {
+	defer finishCall("github", "Check", time.Now(), &err)
+
 	githubRepo, _, err := p.client.Repositories.Get(ctx, p.repo.Owner, p.repo.Name)
 	if err != nil {
 		return fmt.Errorf("github get repository: %w", err)
@@ -46,85 +92,447 @@ func (p *githubProvider) Check(ctx context.Context) error {
 			p.repo.Ref = *githubRepo.DefaultBranch
 		}
 	}
+	if p.repo.IsPinned() {
+		return nil
+	}
+
+	sha, _, err := p.client.Repositories.GetCommitSHA1(ctx, p.repo.Owner, p.repo.Name, p.repo.Ref, "")
+	if err != nil {
+		return fmt.Errorf("github resolve ref %q: %w", p.repo.Ref, err)
+	}
+	p.repo.Commit = sha
 	return nil
 }
 
-func (p *githubProvider) ReadDir(ctx context.Context, path string) ([]*types.Entry, error) {
-	fc, dc, _, err := p.client.Repositories.GetContents(ctx, p.repo.Owner, p.repo.Name, path,
-		&github.RepositoryContentGetOptions{
-			Ref: p.repo.Ref,
-		})
+func (p *githubProvider) ReadDir(ctx context.Context, path string) (ents []*types.Entry, err error) {
+	defer finishCall("github", "ReadDir", time.Now(), &err)
+
+	tree, err := p.getDirTree(ctx, path)
 	if err != nil {
 		return nil, err
 	}
-	if fc != nil {
-		return nil, fmt.Errorf("%q is a file, not directory", path)
+	// The trees API has no pagination, the sub directories are paged by their
+	// own trees, but a directory itself cannot be.
+	if tree.GetTruncated() {
+		return nil, fmt.Errorf("github tree of %q is truncated, it has too many entries", path)
 	}
 
-	ents := make([]*types.Entry, len(dc))
-	for i, content := range dc {
-		path := content.GetPath()
-		name := content.GetName()
-		if path == "" || name == "" {
-			return nil, errors.New("github return entry with empty name or path")
+	return p.convertTreeEntries(path, tree.Entries)
+}
+
+// getDirTree returns the tree of dir. The trees API returns the git modes of
+// entries, which the contents API does not. Use "<revision>:<path>" to get the
+// tree of a sub directory.
+func (p *githubProvider) getDirTree(ctx context.Context, dir string) (*github.Tree, error) {
+	treeish := p.repo.Revision()
+	if dir != "" {
+		treeish = fmt.Sprintf("%s:%s", treeish, escapePath(dir))
+	}
+	tree, _, err := p.client.Git.GetTree(ctx, p.repo.Owner, p.repo.Name, treeish, false)
+	return tree, err
+}
+
+func (p *githubProvider) ReadFile(ctx context.Context, path string) (data []byte, err error) {
+	defer finishCall("github", "ReadFile", time.Now(), &err)
+
+	// The blob is read by its sha from the parent tree, rather than by the
+	// contents API, which cannot find files in directories of more than 1000
+	// entries.
+	dir := pathpkg.Dir(path)
+	if dir == "." {
+		dir = ""
+	}
+	tree, err := p.getDirTree(ctx, dir)
+	if err != nil {
+		return nil, fmt.Errorf("read tree for %q: %w", path, err)
+	}
+	name := pathpkg.Base(path)
+	var sha string
+	for _, treeEnt := range tree.Entries {
+		if treeEnt.GetPath() != name {
+			continue
+		}
+		if treeEnt.GetType() != "blob" {
+			return nil, fmt.Errorf("%q is not a file, its type is %q", path, treeEnt.GetType())
+		}
+		sha = treeEnt.GetSHA()
+		break
+	}
+	if sha == "" {
+		if tree.GetTruncated() {
+			return nil, fmt.Errorf("github tree of %q is truncated, could not find %q", dir, name)
 		}
+		return nil, fmt.Errorf("%w: could not find %q in tree", types.ErrNotFound, path)
+	}
+
+	data, _, err = p.client.Git.GetBlobRaw(ctx, p.repo.Owner, p.repo.Name, sha)
+	if err != nil {
+		return nil, fmt.Errorf("read blob for %q: %w", path, err)
+	}
+	return data, nil
+}
+
+func (p *githubProvider) ReadFileRange(ctx context.Context, path string, off, length int64) (data []byte, err error) {
+	defer finishCall("github", "ReadFileRange", time.Now(), &err)
+
+	// The raw download endpoint supports HTTP Range, while the contents API
+	// does not.
+	rawURL := fmt.Sprintf("https://raw.githubusercontent.com/%s/%s/%s/%s",
+		p.repo.Owner, p.repo.Name, p.repo.Revision(), escapePath(path))
+
+	req, err := p.client.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create raw request for %q: %w", path, err)
+	}
+	req.Header.Set("Range", formatRangeHeader(off, length))
+
+	var buf bytes.Buffer
+	resp, err := p.client.Do(ctx, req, &buf)
+	if err != nil {
+		return nil, err
+	}
 
-		var (
-			isDir     bool
-			isSymLink bool
-			linkName  string
+	return sliceRangeResponse(buf.Bytes(), resp.StatusCode, off, length), nil
+}
 
-			size int64
-		)
-		switch content.GetType() {
-		case "dir":
-			isDir = true
+func (p *githubProvider) ReadTree(ctx context.Context) (ents []*types.Entry, truncated bool, err error) {
+	defer finishCall("github", "ReadTree", time.Now(), &err)
 
-		case "file":
-			size = int64(content.GetSize())
+	tree, _, err := p.client.Git.GetTree(ctx, p.repo.Owner, p.repo.Name, p.repo.Revision(), true)
+	if err != nil {
+		return nil, false, err
+	}
+	if tree.GetTruncated() {
+		return p.readTreeByDirs(ctx, tree.GetSHA())
+	}
+
+	ents, err = p.convertTreeEntries("", tree.Entries)
+	return ents, false, err
+}
 
-		case "symlink":
-			isSymLink = true
-			linkName = content.GetTarget()
-			if linkName == "" {
-				return nil, fmt.Errorf("entry %q is a symlink, but its target is empty", path)
+// readTreeByDirs reads the truncated recursive tree level by level, each sub
+// directory is read by the non-recursive tree of its sha. It gives up and
+// returns truncated if there are too many directories, or the budget is low,
+// so that the directories are read on demand instead.
+func (p *githubProvider) readTreeByDirs(ctx context.Context, sha string) ([]*types.Entry, bool, error) {
+	type dirTree struct {
+		path string
+		sha  string
+	}
+	var ents []*types.Entry
+	level := []dirTree{{sha: sha}}
+	var requests int
+	for len(level) > 0 {
+		requests += len(level)
+		if requests > githubTreeMaxRequests {
+			logrus.Debugf("Read github tree by directories needs more than %d requests, give up", githubTreeMaxRequests)
+			return nil, true, nil
+		}
+		err := p.limiter.checkBudget(len(level))
+		if err != nil {
+			logrus.Debugf("Read github tree by directories error: %v, give up", err)
+			return nil, true, nil
+		}
+
+		levelEnts := make([][]*types.Entry, len(level))
+		var truncated atomic.Bool
+		err = runConcurrent(ctx, len(level), func(ctx context.Context, i int) error {
+			tree, _, err := p.client.Git.GetTree(ctx, p.repo.Owner, p.repo.Name, level[i].sha, false)
+			if err != nil {
+				return fmt.Errorf("read tree for %q: %w", level[i].path, err)
+			}
+			if tree.GetTruncated() {
+				truncated.Store(true)
+				return nil
 			}
+			levelEnts[i], err = p.convertTreeEntries(level[i].path, tree.Entries)
+			return err
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		if truncated.Load() {
+			return nil, true, nil
+		}
+
+		level = level[:0:0]
+		for _, dirEnts := range levelEnts {
+			for _, ent := range dirEnts {
+				ents = append(ents, ent)
+				if ent.IsDir && ent.Submodule == nil {
+					level = append(level, dirTree{path: ent.Path, sha: ent.SHA})
+				}
+			}
+		}
+	}
+	return ents, false, nil
+}
+
+// convertTreeEntries converts the entries of a tree in dir. For recursive
+// tree, the dir should be empty since the entry paths are already full.
+func (p *githubProvider) convertTreeEntries(dir string, treeEnts []*github.TreeEntry) ([]*types.Entry, error) {
+	ents := make([]*types.Entry, 0, len(treeEnts))
+	for _, treeEnt := range treeEnts {
+		path := treeEnt.GetPath()
+		if path == "" {
+			return nil, errors.New("github return tree entry with empty path")
+		}
+		if dir != "" {
+			path = pathpkg.Join(dir, path)
+		}
+
+		mode, err := types.ParseGitMode(treeEnt.GetMode())
+		if err != nil {
+			return nil, fmt.Errorf("invalid mode for %q: %w", path, err)
+		}
+
+		ent := &types.Entry{
+			Path: path,
+			Name: pathpkg.Base(path),
+			Mode: mode,
+			SHA:  treeEnt.GetSHA(),
+		}
+		switch treeEnt.GetType() {
+		case "tree":
+			ent.IsDir = true
+			ent.WebUrl = p.getWebUrl("tree", path)
+
+		case "blob":
+			ent.WebUrl = p.getWebUrl("blob", path)
+			// The target of symlink is read by ReadLink on demand.
+			ent.IsSymLink = mode == types.GitModeSymlink
+			ent.Size = int64(treeEnt.GetSize())
+
+		case "commit":
+			// The submodule, its url is stored in ".gitmodules".
+			ent.IsDir = true
+			ent.Submodule = &types.Submodule{Commit: ent.SHA}
+			ent.WebUrl = p.getWebUrl("tree", path)
 
 		case "":
 			return nil, fmt.Errorf("entry type is empty for %q", path)
 
 		default:
-			return nil, fmt.Errorf("unknown entry type %q for %q", content.GetType(), path)
+			return nil, fmt.Errorf("unknown entry type %q for %q", treeEnt.GetType(), path)
 		}
 
-		ents[i] = &types.Entry{
-			Path:      path,
-			Name:      name,
-			IsDir:     isDir,
-			IsSymLink: isSymLink,
-			LinkName:  linkName,
-			Size:      size,
-			WebUrl:    content.GetHTMLURL(),
-		}
+		ents = append(ents, ent)
 	}
 
 	return ents, nil
 }
 
-func (p *githubProvider) ReadFile(ctx context.Context, path string) ([]byte, error) {
-	reader, _, err := p.client.Repositories.DownloadContents(ctx, p.repo.Owner, p.repo.Name, path,
-		&github.RepositoryContentGetOptions{
-			Ref: p.repo.Ref,
-		})
+func (p *githubProvider) ReadLink(ctx context.Context, ent *types.Entry) (target string, err error) {
+	defer finishCall("github", "ReadLink", time.Now(), &err)
+
+	// The target of symlink is the content of its blob.
+	data, _, err := p.client.Git.GetBlobRaw(ctx, p.repo.Owner, p.repo.Name, ent.SHA)
+	if err != nil {
+		return "", fmt.Errorf("read symlink target for %q: %w", ent.Path, err)
+	}
+	if len(data) == 0 {
+		return "", fmt.Errorf("entry %q is a symlink, but its target is empty", ent.Path)
+	}
+	return string(data), nil
+}
+
+func (p *githubProvider) getWebUrl(kind, path string) string {
+	return fmt.Sprintf("https://%s/%s/%s/%s/%s/%s", p.repo.Domain, p.repo.Owner, p.repo.Name,
+		kind, p.repo.Revision(), path)
+}
+
+func (p *githubProvider) ReadLastCommits(ctx context.Context, paths []string) (result map[string]*types.Commit, err error) {
+	defer finishCall("github", "ReadLastCommits", time.Now(), &err)
+
+	if p.graphqlURL != "" {
+		result, err = p.queryLastCommits(ctx, paths)
+		if err == nil || ctx.Err() != nil {
+			return result, err
+		}
+		logrus.Debugf("Query last commits by GitHub GraphQL error: %v, fallback to list commits", err)
+	}
+
+	return readCommitsByPath(ctx, p.limiter, paths, func(ctx context.Context, path string) (*types.Commit, error) {
+		githubCommits, _, err := p.client.Repositories.ListCommits(ctx, p.repo.Owner, p.repo.Name,
+			&github.CommitsListOptions{
+				SHA:  p.repo.Revision(),
+				Path: path,
+
+				ListOptions: github.ListOptions{PerPage: 1},
+			})
+		if err != nil || len(githubCommits) == 0 {
+			return nil, err
+		}
+
+		commit := githubCommits[0]
+		return &types.Commit{
+			SHA:    commit.GetSHA(),
+			Author: commit.GetCommit().GetAuthor().GetName(),
+			Time:   commit.GetCommit().GetCommitter().GetDate().Time,
+		}, nil
+	})
+}
+
+const githubCommitFields = "oid committedDate author { name }"
+
+type githubGraphQLCommit struct {
+	OID           string    `json:"oid"`
+	CommittedDate time.Time `json:"committedDate"`
+	Author        struct {
+		Name string `json:"name"`
+	} `json:"author"`
+}
+
+type githubHistoryResponse struct {
+	Data struct {
+		Repository *struct {
+			Object map[string]json.RawMessage `json:"object"`
+		} `json:"repository"`
+	} `json:"data"`
+
+	Errors []graphQLError `json:"errors"`
+}
+
+// queryLastCommits reads the last commits of paths by GraphQL, the history of
+// up to githubGraphQLBatch paths is queried in one request.
+func (p *githubProvider) queryLastCommits(ctx context.Context, paths []string) (map[string]*types.Commit, error) {
+	batches := (len(paths) + githubGraphQLBatch - 1) / githubGraphQLBatch
+	commits := make([]*types.Commit, len(paths))
+	err := runConcurrent(ctx, batches, func(ctx context.Context, i int) error {
+		start := i * githubGraphQLBatch
+		end := start + githubGraphQLBatch
+		if end > len(paths) {
+			end = len(paths)
+		}
+		return p.queryLastCommitsBatch(ctx, paths[start:end], commits[start:end])
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer reader.Close()
 
-	data, err := io.ReadAll(reader)
+	return collectCommits(paths, commits), nil
+}
+
+func (p *githubProvider) queryLastCommitsBatch(ctx context.Context, paths []string, commits []*types.Commit) error {
+	var params, fields strings.Builder
+	variables := map[string]interface{}{
+		"owner": p.repo.Owner,
+		"name":  p.repo.Name,
+		"rev":   p.repo.Revision(),
+	}
+	for i, path := range paths {
+		if path == "" {
+			// The commit of revision itself.
+			fields.WriteString(githubCommitFields + "\n")
+			continue
+		}
+		fmt.Fprintf(&params, ", $p%d: String!", i)
+		fmt.Fprintf(&fields, "p%d: history(first: 1, path: $p%d) { nodes { %s } }\n", i, i, githubCommitFields)
+		variables[fmt.Sprintf("p%d", i)] = path
+	}
+	query := fmt.Sprintf(`query($owner: String!, $name: String!, $rev: String!%s) {
+  repository(owner: $owner, name: $name) {
+    object(expression: $rev) {
+      ... on Commit {
+%s      }
+    }
+  }
+}`, params.String(), fields.String())
+
+	req, err := p.client.NewRequest(http.MethodPost, p.graphqlURL, &graphQLRequest{
+		Query:     query,
+		Variables: variables,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("read content for %q: %w", path, err)
+		return fmt.Errorf("create graphql request: %w", err)
 	}
 
-	return data, nil
+	var resp githubHistoryResponse
+	_, err = p.client.Do(ctx, req, &resp)
+	if err != nil {
+		return err
+	}
+	if len(resp.Errors) > 0 {
+		return fmt.Errorf("graphql error: %s", resp.Errors[0].Message)
+	}
+	if resp.Data.Repository == nil || resp.Data.Repository.Object == nil {
+		return fmt.Errorf("graphql returns empty object for revision %q", p.repo.Revision())
+	}
+	object := resp.Data.Repository.Object
+
+	for i, path := range paths {
+		var commit *githubGraphQLCommit
+		if path == "" {
+			commit = new(githubGraphQLCommit)
+			err = json.Unmarshal(object["oid"], &commit.OID)
+			if err == nil {
+				err = json.Unmarshal(object["committedDate"], &commit.CommittedDate)
+			}
+			if err == nil {
+				err = json.Unmarshal(object["author"], &commit.Author)
+			}
+		} else {
+			var history struct {
+				Nodes []*githubGraphQLCommit `json:"nodes"`
+			}
+			err = json.Unmarshal(object[fmt.Sprintf("p%d", i)], &history)
+			if len(history.Nodes) > 0 {
+				commit = history.Nodes[0]
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("decode graphql commit for %q: %w", path, err)
+		}
+		if commit == nil {
+			continue
+		}
+		commits[i] = &types.Commit{
+			SHA:    commit.OID,
+			Author: commit.Author.Name,
+			Time:   commit.CommittedDate,
+		}
+	}
+	return nil
+}
+
+func (p *githubProvider) ListBranches(ctx context.Context) (names []string, err error) {
+	defer finishCall("github", "ListBranches", time.Now(), &err)
+
+	opts := &github.BranchListOptions{
+		ListOptions: github.ListOptions{PerPage: githubMaxPerPage},
+	}
+
+	for {
+		branches, resp, err := p.client.Repositories.ListBranches(ctx, p.repo.Owner, p.repo.Name, opts)
+		if err != nil {
+			return nil, fmt.Errorf("github list branches: %w", err)
+		}
+		for _, branch := range branches {
+			names = append(names, branch.GetName())
+		}
+		if resp.NextPage == 0 {
+			return names, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+func (p *githubProvider) ListTags(ctx context.Context) (names []string, err error) {
+	defer finishCall("github", "ListTags", time.Now(), &err)
+
+	opts := &github.ListOptions{PerPage: githubMaxPerPage}
+
+	for {
+		tags, resp, err := p.client.Repositories.ListTags(ctx, p.repo.Owner, p.repo.Name, opts)
+		if err != nil {
+			return nil, fmt.Errorf("github list tags: %w", err)
+		}
+		for _, tag := range tags {
+			names = append(names, tag.GetName())
+		}
+		if resp.NextPage == 0 {
+			return names, nil
+		}
+		opts.Page = resp.NextPage
+	}
 }
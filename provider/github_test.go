@@ -0,0 +1,344 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fioncat/grfs/types"
+)
+
+func newTestGithub(t *testing.T, handler http.Handler) *githubProvider {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	repo := &types.Repository{
+		Domain: "github.com",
+		Owner:  "fioncat",
+		Name:   "grfs",
+		Commit: "abc",
+	}
+	p := newGithub(repo, "test-token", &rateLimiter{domain: "test"}, &types.RetryConfig{
+		Attempts:   1,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: time.Millisecond,
+		Deadline:   time.Second,
+	}).(*githubProvider)
+	p.client.BaseURL, _ = url.Parse(server.URL + "/")
+	p.graphqlURL = server.URL + "/graphql"
+	return p
+}
+
+var testCommitTime = time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC)
+
+func TestGithubReadLastCommits(t *testing.T) {
+	var queries atomic.Int32
+	p := newTestGithub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/graphql" {
+			t.Errorf("Unexpect request %s", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		queries.Add(1)
+
+		var req graphQLRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		object := map[string]interface{}{
+			"oid":           "ref",
+			"committedDate": testCommitTime,
+			"author":        map[string]string{"name": "ref-author"},
+		}
+		for name, value := range req.Variables {
+			if !strings.HasPrefix(name, "p") {
+				continue
+			}
+			if !strings.Contains(req.Query, fmt.Sprintf("%s: history(first: 1, path: $%s)", name, name)) {
+				t.Errorf("Expect history query for %s", name)
+			}
+			var nodes []interface{}
+			if value != "missing" {
+				nodes = append(nodes, map[string]interface{}{
+					"oid":           "sha-" + value.(string),
+					"committedDate": testCommitTime,
+					"author":        map[string]string{"name": "author"},
+				})
+			}
+			object[name] = map[string]interface{}{"nodes": nodes}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"repository": map[string]interface{}{"object": object},
+			},
+		})
+	}))
+
+	paths := []string{"", "missing"}
+	for i := 0; i < githubGraphQLBatch+10; i++ {
+		paths = append(paths, fmt.Sprintf("dir/file-%d", i))
+	}
+	commits, err := p.ReadLastCommits(context.Background(), paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := queries.Load(); n != 2 {
+		t.Fatalf("Expect 2 graphql queries, got %d", n)
+	}
+	if len(commits) != len(paths)-1 {
+		t.Fatalf("Expect %d commits, got %d", len(paths)-1, len(commits))
+	}
+	if commit := commits[""]; commit == nil || commit.SHA != "ref" || commit.Author != "ref-author" {
+		t.Fatalf("Unexpect ref commit %+v", commit)
+	}
+	if _, ok := commits["missing"]; ok {
+		t.Fatal("Expect no commit for missing path")
+	}
+	commit := commits["dir/file-3"]
+	if commit == nil || commit.SHA != "sha-dir/file-3" || !commit.Time.Equal(testCommitTime) {
+		t.Fatalf("Unexpect commit %+v", commit)
+	}
+}
+
+func TestGithubReadLastCommitsFallback(t *testing.T) {
+	var lists atomic.Int32
+	p := newTestGithub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/graphql":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"errors": []map[string]string{{"message": "something wrong"}},
+			})
+
+		case "/repos/fioncat/grfs/commits":
+			lists.Add(1)
+			json.NewEncoder(w).Encode([]map[string]interface{}{{
+				"sha": "sha-" + r.URL.Query().Get("path"),
+				"commit": map[string]interface{}{
+					"committer": map[string]interface{}{"date": testCommitTime},
+				},
+			}})
+
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	commits, err := p.ReadLastCommits(context.Background(), []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lists.Load() != 2 || len(commits) != 2 || commits["b"].SHA != "sha-b" {
+		t.Fatalf("Expect fallback to list commits, got %d lists, %+v", lists.Load(), commits)
+	}
+
+	// The fallback costs a request per path, it is skipped when the budget
+	// would become low.
+	p.limiter.limit, p.limiter.remaining = 100, 20
+	p.limiter.reset, p.limiter.known = time.Now().Add(time.Hour), true
+	_, err = p.ReadLastCommits(context.Background(), []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k"})
+	if !errors.Is(err, types.ErrRateLimited) {
+		t.Fatalf("Expect rate limited error for low budget, got %v", err)
+	}
+	if lists.Load() != 2 {
+		t.Fatalf("Expect no list with low budget, got %d lists", lists.Load())
+	}
+}
+
+func TestGithubReadDir(t *testing.T) {
+	var blobs atomic.Int32
+	p := newTestGithub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/repos/fioncat/grfs/git/trees/"):
+			// The path should be escaped, rather than being cut by "#" or "?".
+			expect := "/repos/fioncat/grfs/git/trees/abc:docs/a%23b%3F/c%25d%20e"
+			if r.URL.EscapedPath() != expect {
+				t.Errorf("Unexpect tree url %q, expect %q", r.URL.EscapedPath(), expect)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"sha": "tree",
+				"tree": []map[string]interface{}{
+					{"path": "main.go", "mode": "100644", "type": "blob", "sha": "b1", "size": 10},
+					{"path": "link", "mode": "120000", "type": "blob", "sha": "b2", "size": 7},
+				},
+			})
+
+		case r.URL.Path == "/repos/fioncat/grfs/git/blobs/b2":
+			blobs.Add(1)
+			w.Write([]byte("main.go"))
+
+		default:
+			t.Errorf("Unexpect request %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+
+	ents, err := p.ReadDir(context.Background(), "docs/a#b?/c%d e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 2 || ents[0].Path != "docs/a#b?/c%d e/main.go" {
+		t.Fatalf("Unexpect entries %+v", ents)
+	}
+	link := ents[1]
+	if !link.IsSymLink || link.LinkName != "" || link.Size != 7 {
+		t.Fatalf("Expect symlink with unresolved target, got %+v", link)
+	}
+	if blobs.Load() != 0 {
+		t.Fatal("Expect symlink target not to be read when listing")
+	}
+
+	target, err := p.ReadLink(context.Background(), link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "main.go" || blobs.Load() != 1 {
+		t.Fatalf("Unexpect symlink target %q", target)
+	}
+}
+
+func TestGithubReadDirTruncated(t *testing.T) {
+	p := newTestGithub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/fioncat/grfs/git/trees/abc:big" {
+			t.Errorf("Unexpect request %s", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"sha":       "tree",
+			"truncated": true,
+			"tree": []map[string]interface{}{
+				{"path": "run.sh", "mode": "100755", "type": "blob", "sha": "b1", "size": 10},
+			},
+		})
+	}))
+
+	// The partial listing should never be served.
+	_, err := p.ReadDir(context.Background(), "big")
+	if err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Fatalf("Expect truncated error, got %v", err)
+	}
+}
+
+func TestGithubReadTreeTruncated(t *testing.T) {
+	trees := map[string][]map[string]interface{}{
+		"root": {
+			{"path": "README.md", "mode": "100644", "type": "blob", "sha": "b1", "size": 10},
+			{"path": "src", "mode": "040000", "type": "tree", "sha": "t1"},
+			{"path": "lib", "mode": "160000", "type": "commit", "sha": "c1"},
+		},
+		"t1": {
+			{"path": "main.go", "mode": "100644", "type": "blob", "sha": "b2", "size": 20},
+			{"path": "pkg", "mode": "040000", "type": "tree", "sha": "t2"},
+		},
+		"t2": {
+			{"path": "run.sh", "mode": "100755", "type": "blob", "sha": "b3", "size": 30},
+		},
+	}
+	var requests atomic.Int32
+	p := newTestGithub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		sha := strings.TrimPrefix(r.URL.Path, "/repos/fioncat/grfs/git/trees/")
+		if sha == "abc" {
+			if r.URL.Query().Get("recursive") == "" {
+				t.Errorf("Expect recursive tree for revision")
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"sha":       "root",
+				"truncated": true,
+				"tree":      trees["root"][:1],
+			})
+			return
+		}
+		if r.URL.Query().Get("recursive") != "" {
+			t.Errorf("Expect non-recursive tree for %q", sha)
+		}
+		treeEnts, ok := trees[sha]
+		if !ok {
+			t.Errorf("Unexpect request %s", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"sha": sha, "tree": treeEnts})
+	}))
+
+	ents, truncated, err := p.ReadTree(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if truncated {
+		t.Fatal("Expect the truncated tree to be read by directories")
+	}
+	var paths []string
+	for _, ent := range ents {
+		paths = append(paths, ent.Path)
+	}
+	expect := "README.md,src,lib,src/main.go,src/pkg,src/pkg/run.sh"
+	if strings.Join(paths, ",") != expect {
+		t.Fatalf("Unexpect tree paths %v, expect %s", paths, expect)
+	}
+	// The submodule is not read.
+	if n := requests.Load(); n != 4 {
+		t.Fatalf("Expect 4 requests, got %d", n)
+	}
+
+	// Gives up on low budget, the directories are read on demand.
+	p.limiter.limit, p.limiter.remaining = 100, 11
+	p.limiter.reset, p.limiter.known = time.Now().Add(time.Hour), true
+	requests.Store(0)
+	_, truncated, err = p.ReadTree(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated || requests.Load() != 1 {
+		t.Fatalf("Expect truncated tree on low budget, got %v with %d requests", truncated, requests.Load())
+	}
+}
+
+func TestGithubReadFile(t *testing.T) {
+	p := newTestGithub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/repos/fioncat/grfs/git/trees/abc:docs":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"sha": "tree",
+				"tree": []map[string]interface{}{
+					{"path": "a.md", "mode": "100644", "type": "blob", "sha": "b1", "size": 5},
+					{"path": "sub", "mode": "040000", "type": "tree", "sha": "t1"},
+				},
+			})
+
+		case "/repos/fioncat/grfs/git/blobs/b1":
+			w.Write([]byte("hello"))
+
+		default:
+			t.Errorf("Unexpect request %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+
+	ctx := context.Background()
+	data, err := p.ReadFile(ctx, "docs/a.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Unexpect file content %q", data)
+	}
+	_, err = p.ReadFile(ctx, "docs/b.md")
+	if !errors.Is(err, types.ErrNotFound) {
+		t.Fatalf("Expect not found error, got %v", err)
+	}
+	_, err = p.ReadFile(ctx, "docs/sub")
+	if err == nil || errors.Is(err, types.ErrNotFound) {
+		t.Fatalf("Expect error for directory, got %v", err)
+	}
+}
@@ -2,94 +2,448 @@ package provider
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/fioncat/grfs/types"
+	"github.com/sirupsen/logrus"
 	"github.com/xanzy/go-gitlab"
 )
 
+const gitlabMaxPerPage = 100
+
 type gitlabProvider struct {
 	repo *types.Repository
 
 	client *gitlab.Client
+
+	limiter *rateLimiter
+
+	// graphqlURL is not under the REST base url "/api/v4".
+	graphqlURL string
 }
 
-func newGitlab(repo *types.Repository, token string) (types.Provider, error) {
+func newGitlab(repo *types.Repository, token string, limiter *rateLimiter, retryCfg *types.RetryConfig) (types.Provider, error) {
 	url := fmt.Sprintf("https://%s/api/v4", repo.Domain)
-	client, err := gitlab.NewClient(token, gitlab.WithBaseURL(url))
+	httpCli := &http.Client{
+		Transport: &retryTransport{
+			cfg: retryCfg,
+			base: &rateLimitTransport{
+				limiter: limiter,
+				base:    http.DefaultTransport,
+			},
+		},
+	}
+	// The retries of go-gitlab are disabled, which is done by our transport.
+	client, err := gitlab.NewClient(token, gitlab.WithBaseURL(url), gitlab.WithHTTPClient(httpCli),
+		gitlab.WithoutRetries())
 	if err != nil {
 		return nil, err
 	}
 
 	return &gitlabProvider{
-		repo:   repo,
-		client: client,
+		repo:       repo,
+		client:     client,
+		limiter:    limiter,
+		graphqlURL: fmt.Sprintf("https://%s/api/graphql", repo.Domain),
 	}, nil
 }
 
-func (p *gitlabProvider) Check(ctx context.Context) error {
-	project, _, err := p.client.Projects.GetProject(p.repo.Path(), &gitlab.GetProjectOptions{})
+func (p *gitlabProvider) RateLimit() *types.RateLimit {
+	return p.limiter.RateLimit()
+}
+
+func (p *gitlabProvider) Check(ctx context.Context) (err error) {
+	defer finishCall("gitlab", "Check", time.Now(), &err)
+
+	project, _, err := p.client.Projects.GetProject(p.repo.Path(), &gitlab.GetProjectOptions{}, gitlab.WithContext(ctx))
 	if err != nil {
 		return fmt.Errorf("gitlab get project: %w", err)
 	}
 	if p.repo.Ref == "" {
 		p.repo.Ref = project.DefaultBranch
 	}
+	if p.repo.IsPinned() {
+		return nil
+	}
 
+	commit, _, err := p.client.Commits.GetCommit(p.repo.Path(), p.repo.Ref, gitlab.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("gitlab resolve ref %q: %w", p.repo.Ref, err)
+	}
+	p.repo.Commit = commit.ID
 	return nil
 }
 
-func (p *gitlabProvider) ReadDir(ctx context.Context, path string) ([]*types.Entry, error) {
-	nodes, _, err := p.client.Repositories.ListTree(p.repo.Path(), &gitlab.ListTreeOptions{
+func (p *gitlabProvider) ReadDir(ctx context.Context, path string) (ents []*types.Entry, err error) {
+	defer finishCall("gitlab", "ReadDir", time.Now(), &err)
+
+	nodes, err := p.listTree(ctx, &gitlab.ListTreeOptions{
 		Path: gitlab.Ptr(path),
-		Ref:  &p.repo.Ref,
+		Ref:  gitlab.Ptr(p.repo.Revision()),
 	})
 	if err != nil {
-		fmt.Printf("Path: %q\n", path)
 		return nil, err
 	}
 
+	ents, err = p.convertNodes(nodes)
+	if err != nil {
+		return nil, err
+	}
+	err = p.ReadSizes(ctx, ents)
+	if err != nil {
+		return nil, err
+	}
+	return ents, nil
+}
+
+func (p *gitlabProvider) ReadTree(ctx context.Context) (ents []*types.Entry, truncated bool, err error) {
+	defer finishCall("gitlab", "ReadTree", time.Now(), &err)
+
+	nodes, err := p.listTree(ctx, &gitlab.ListTreeOptions{
+		Ref:       gitlab.Ptr(p.repo.Revision()),
+		Recursive: gitlab.Ptr(true),
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	// The sizes are read for the listed directories only, see ReadSizes.
+	ents, err = p.convertNodes(nodes)
+	return ents, false, err
+}
+
+// listTree lists all the tree nodes by following the pagination, the
+// listing is checked against the total count returned by GitLab.
+func (p *gitlabProvider) listTree(ctx context.Context, opts *gitlab.ListTreeOptions) ([]*gitlab.TreeNode, error) {
+	opts.Page = 1
+	opts.PerPage = gitlabMaxPerPage
+
+	var nodes []*gitlab.TreeNode
+	for {
+		pageNodes, resp, err := p.client.Repositories.ListTree(p.repo.Path(), opts, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("gitlab list tree page %d: %w", opts.Page, err)
+		}
+		nodes = append(nodes, pageNodes...)
+		if resp.NextPage == 0 {
+			// GitLab omits the total count for very large listings.
+			if resp.TotalItems > 0 && len(nodes) != resp.TotalItems {
+				return nil, fmt.Errorf("gitlab tree listing is incomplete, got %d of %d entries", len(nodes), resp.TotalItems)
+			}
+			return nodes, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+func (p *gitlabProvider) convertNodes(nodes []*gitlab.TreeNode) ([]*types.Entry, error) {
 	ents := make([]*types.Entry, len(nodes))
 	for i, node := range nodes {
 		if node.Path == "" || node.Name == "" {
 			return nil, errors.New("Gitlab return entry with empty name or path")
 		}
 
-		var isDir bool
-		var size int64
+		mode, err := types.ParseGitMode(node.Mode)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mode for %q: %w", node.Path, err)
+		}
+
+		var isDir, isSymLink bool
+		var submodule *types.Submodule
 		switch node.Type {
 		case "tree":
 			isDir = true
 
+		case "commit":
+			// The submodule, its url is stored in ".gitmodules".
+			isDir = true
+			submodule = &types.Submodule{Commit: node.ID}
+
 		case "blob":
-			// TODO: Handle symlink, use node.Mode
 			// FIXME: How to get the web url for gitlab entry?
 
-			fileMeta, _, err := p.client.RepositoryFiles.GetFileMetaData(p.repo.Path(), node.Path, &gitlab.GetFileMetaDataOptions{
-				Ref: &p.repo.Ref,
-			})
-			if err != nil {
-				return nil, fmt.Errorf("Get file meta for %q: %w", node.Path, err)
-			}
-			size = int64(fileMeta.Size)
+			// The target of symlink is read by ReadLink on demand.
+			isSymLink = mode == types.GitModeSymlink
+			// The size is filled later, see ReadSizes. For symlinks, it is
+			// the length of target.
 
+		default:
+			return nil, fmt.Errorf("unknown entry type %q for %q", node.Type, node.Path)
 		}
 
 		ents[i] = &types.Entry{
 			Path:  node.Path,
 			Name:  node.Name,
 			IsDir: isDir,
-			Size:  size,
+			Mode:  mode,
+
+			IsSymLink: isSymLink,
+
+			Submodule: submodule,
+
+			SHA: node.ID,
 		}
 	}
 
 	return ents, nil
 }
 
-func (p *gitlabProvider) ReadFile(ctx context.Context, path string) ([]byte, error) {
-	data, _, err := p.client.RepositoryFiles.GetRawFile(p.repo.Path(), path, &gitlab.GetRawFileOptions{
-		Ref: &p.repo.Ref,
+func (p *gitlabProvider) ReadLink(ctx context.Context, ent *types.Entry) (target string, err error) {
+	defer finishCall("gitlab", "ReadLink", time.Now(), &err)
+
+	// The target of symlink is the content of its blob.
+	data, _, err := p.client.Repositories.RawBlobContent(p.repo.Path(), ent.SHA, gitlab.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("read symlink target for %q: %w", ent.Path, err)
+	}
+	if len(data) == 0 {
+		return "", fmt.Errorf("entry %q is a symlink, but its target is empty", ent.Path)
+	}
+	return string(data), nil
+}
+
+// gitlabGraphQLBatch is the max number of paths queried in one GraphQL
+// request.
+const gitlabGraphQLBatch = 100
+
+const gitlabBlobsQuery = `query($project: ID!, $ref: String!, $paths: [String!]!) {
+  project(fullPath: $project) {
+    repository {
+      blobs(ref: $ref, paths: $paths) {
+        nodes { path size }
+      }
+    }
+  }
+}`
+
+type gitlabBlobsResponse struct {
+	Data struct {
+		Project *struct {
+			Repository struct {
+				Blobs struct {
+					Nodes []struct {
+						Path string          `json:"path"`
+						Size json.RawMessage `json:"size"`
+					} `json:"nodes"`
+				} `json:"blobs"`
+			} `json:"repository"`
+		} `json:"project"`
+	} `json:"data"`
+
+	Errors []graphQLError `json:"errors"`
+}
+
+// ReadSizes fills the sizes of file entries. The tree API does not return
+// sizes, so they are queried in bulk by GraphQL, the batches are sent
+// concurrently. The files missed by GraphQL fallback to reading the file
+// metadata one by one, concurrently.
+func (p *gitlabProvider) ReadSizes(ctx context.Context, ents []*types.Entry) (err error) {
+	var files []*types.Entry
+	for _, ent := range ents {
+		if !ent.IsDir {
+			files = append(files, ent)
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	defer finishCall("gitlab", "ReadSizes", time.Now(), &err)
+
+	batches := (len(files) + gitlabGraphQLBatch - 1) / gitlabGraphQLBatch
+	batchMissing := make([][]*types.Entry, batches)
+	err = runConcurrent(ctx, batches, func(ctx context.Context, i int) error {
+		start := i * gitlabGraphQLBatch
+		end := start + gitlabGraphQLBatch
+		if end > len(files) {
+			end = len(files)
+		}
+		batch := files[start:end]
+
+		sizes, err := p.queryBlobSizes(ctx, batch)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			logrus.Debugf("Query blob sizes by GitLab GraphQL error: %v, fallback to file metadata", err)
+		}
+		for _, ent := range batch {
+			size, ok := sizes[ent.Path]
+			if !ok {
+				batchMissing[i] = append(batchMissing[i], ent)
+				continue
+			}
+			ent.Size = size
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var missing []*types.Entry
+	for _, ents := range batchMissing {
+		missing = append(missing, ents...)
+	}
+	return runConcurrent(ctx, len(missing), func(ctx context.Context, i int) error {
+		ent := missing[i]
+		fileMeta, _, err := p.client.RepositoryFiles.GetFileMetaData(p.repo.Path(), ent.Path, &gitlab.GetFileMetaDataOptions{
+			Ref: gitlab.Ptr(p.repo.Revision()),
+		}, gitlab.WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("Get file meta for %q: %w", ent.Path, err)
+		}
+		ent.Size = int64(fileMeta.Size)
+		return nil
 	})
+}
+
+func (p *gitlabProvider) queryBlobSizes(ctx context.Context, ents []*types.Entry) (map[string]int64, error) {
+	paths := make([]string, len(ents))
+	for i, ent := range ents {
+		paths[i] = ent.Path
+	}
+	body := &graphQLRequest{
+		Query: gitlabBlobsQuery,
+		Variables: map[string]interface{}{
+			"project": p.repo.Path(),
+			"ref":     p.repo.Revision(),
+			"paths":   paths,
+		},
+	}
+
+	req, err := p.client.NewRequest(http.MethodPost, "", body, []gitlab.RequestOptionFunc{gitlab.WithContext(ctx)})
+	if err != nil {
+		return nil, fmt.Errorf("create graphql request: %w", err)
+	}
+	req.URL, err = url.Parse(p.graphqlURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp gitlabBlobsResponse
+	_, err = p.client.Do(req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Errors) > 0 {
+		return nil, fmt.Errorf("graphql error: %s", resp.Errors[0].Message)
+	}
+	if resp.Data.Project == nil {
+		return nil, errors.New("graphql returns empty project")
+	}
+
+	sizes := make(map[string]int64, len(ents))
+	for _, node := range resp.Data.Project.Repository.Blobs.Nodes {
+		// The size is a BigInt, which might be encoded as a string.
+		raw := strings.Trim(string(node.Size), `"`)
+		size, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size %q for %q", raw, node.Path)
+		}
+		sizes[node.Path] = size
+	}
+	return sizes, nil
+}
+
+func (p *gitlabProvider) ReadFile(ctx context.Context, path string) (data []byte, err error) {
+	defer finishCall("gitlab", "ReadFile", time.Now(), &err)
+
+	data, _, err = p.client.RepositoryFiles.GetRawFile(p.repo.Path(), path, &gitlab.GetRawFileOptions{
+		Ref: gitlab.Ptr(p.repo.Revision()),
+	}, gitlab.WithContext(ctx))
 	return data, err
 }
+
+func (p *gitlabProvider) ReadFileRange(ctx context.Context, path string, off, length int64) (data []byte, err error) {
+	defer finishCall("gitlab", "ReadFileRange", time.Now(), &err)
+
+	data, resp, err := p.client.RepositoryFiles.GetRawFile(p.repo.Path(), path, &gitlab.GetRawFileOptions{
+		Ref: gitlab.Ptr(p.repo.Revision()),
+	}, gitlab.WithContext(ctx), gitlab.WithHeader("Range", formatRangeHeader(off, length)))
+	if err != nil {
+		return nil, err
+	}
+
+	return sliceRangeResponse(data, resp.StatusCode, off, length), nil
+}
+
+// ReadLastCommits lists the commits of paths one by one concurrently, since
+// GitLab has no API to read the last commits of many paths in one request.
+func (p *gitlabProvider) ReadLastCommits(ctx context.Context, paths []string) (result map[string]*types.Commit, err error) {
+	defer finishCall("gitlab", "ReadLastCommits", time.Now(), &err)
+
+	return readCommitsByPath(ctx, p.limiter, paths, func(ctx context.Context, path string) (*types.Commit, error) {
+		opts := &gitlab.ListCommitsOptions{
+			ListOptions: gitlab.ListOptions{PerPage: 1},
+			RefName:     gitlab.Ptr(p.repo.Revision()),
+		}
+		if path != "" {
+			opts.Path = gitlab.Ptr(path)
+		}
+		gitlabCommits, _, err := p.client.Commits.ListCommits(p.repo.Path(), opts, gitlab.WithContext(ctx))
+		if err != nil || len(gitlabCommits) == 0 {
+			return nil, err
+		}
+
+		commit := gitlabCommits[0]
+		result := &types.Commit{
+			SHA:    commit.ID,
+			Author: commit.AuthorName,
+		}
+		if commit.CommittedDate != nil {
+			result.Time = *commit.CommittedDate
+		}
+		return result, nil
+	})
+}
+
+func (p *gitlabProvider) ListBranches(ctx context.Context) (names []string, err error) {
+	defer finishCall("gitlab", "ListBranches", time.Now(), &err)
+
+	opts := &gitlab.ListBranchesOptions{
+		ListOptions: gitlab.ListOptions{PerPage: gitlabMaxPerPage},
+	}
+
+	for {
+		branches, resp, err := p.client.Branches.ListBranches(p.repo.Path(), opts, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("gitlab list branches: %w", err)
+		}
+		for _, branch := range branches {
+			names = append(names, branch.Name)
+		}
+		if resp.NextPage == 0 {
+			return names, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+func (p *gitlabProvider) ListTags(ctx context.Context) (names []string, err error) {
+	defer finishCall("gitlab", "ListTags", time.Now(), &err)
+
+	opts := &gitlab.ListTagsOptions{
+		ListOptions: gitlab.ListOptions{PerPage: gitlabMaxPerPage},
+	}
+
+	for {
+		tags, resp, err := p.client.Tags.ListTags(p.repo.Path(), opts, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("gitlab list tags: %w", err)
+		}
+		for _, tag := range tags {
+			names = append(names, tag.Name)
+		}
+		if resp.NextPage == 0 {
+			return names, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
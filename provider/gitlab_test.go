@@ -0,0 +1,257 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fioncat/grfs/types"
+	"github.com/xanzy/go-gitlab"
+)
+
+const testGitlabTreePath = "/api/v4/projects/fioncat/grfs/repository/tree"
+
+func newTestGitlab(t *testing.T, handler http.Handler) *gitlabProvider {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	repo := &types.Repository{
+		Domain: "gitlab.com",
+		Owner:  "fioncat",
+		Name:   "grfs",
+		Commit: "abc",
+	}
+	prov, err := newGitlab(repo, "test-token", &rateLimiter{domain: "test"}, &types.RetryConfig{
+		Attempts:   1,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: time.Millisecond,
+		Deadline:   time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := prov.(*gitlabProvider)
+	// The base url of go-gitlab client cannot be changed after created.
+	p.client, err = gitlab.NewClient("test-token", gitlab.WithBaseURL(server.URL+"/api/v4"),
+		gitlab.WithHTTPClient(server.Client()), gitlab.WithoutRetries())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.graphqlURL = server.URL + "/api/graphql"
+	return p
+}
+
+func TestGitlabReadTree(t *testing.T) {
+	p := newTestGitlab(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != testGitlabTreePath {
+			t.Errorf("Unexpect request %s", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		query := r.URL.Query()
+		if query.Get("ref") != "abc" || query.Get("recursive") != "true" {
+			t.Errorf("Unexpect tree query %q", r.URL.RawQuery)
+		}
+		json.NewEncoder(w).Encode([]map[string]interface{}{
+			{"id": "t1", "name": "src", "type": "tree", "path": "src", "mode": "040000"},
+			{"id": "b1", "name": "run.sh", "type": "blob", "path": "src/run.sh", "mode": "100755"},
+			{"id": "b2", "name": "link", "type": "blob", "path": "link", "mode": "120000"},
+			{"id": "c1", "name": "lib", "type": "commit", "path": "lib", "mode": "160000"},
+		})
+	}))
+
+	ents, truncated, err := p.ReadTree(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if truncated || len(ents) != 4 {
+		t.Fatalf("Unexpect tree entries %+v, truncated %v", ents, truncated)
+	}
+	expects := []struct {
+		path  string
+		mode  uint32
+		isDir bool
+		link  bool
+		sha   string
+	}{
+		{"src", types.GitModeTree, true, false, "t1"},
+		{"src/run.sh", types.GitModeExecutable, false, false, "b1"},
+		{"link", types.GitModeSymlink, false, true, "b2"},
+		{"lib", types.GitModeSubmodule, true, false, "c1"},
+	}
+	for i, expect := range expects {
+		ent := ents[i]
+		if ent.Path != expect.path || ent.Mode != expect.mode || ent.IsDir != expect.isDir ||
+			ent.IsSymLink != expect.link || ent.SHA != expect.sha {
+			t.Fatalf("Unexpect entry %d: %+v", i, ent)
+		}
+	}
+	// The submodule is pinned at the commit of its node.
+	if submodule := ents[3].Submodule; submodule == nil || submodule.Commit != "c1" {
+		t.Fatalf("Expect submodule at commit c1, got %+v", submodule)
+	}
+	if ents[2].Submodule != nil {
+		t.Fatalf("Expect symlink not to be submodule, got %+v", ents[2])
+	}
+}
+
+func TestGitlabListTreePages(t *testing.T) {
+	testCases := []struct {
+		name  string
+		total string
+
+		err bool
+	}{
+		{name: "complete", total: "5"},
+		{name: "without total", total: ""},
+		{name: "incomplete", total: "8", err: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var pages []string
+			p := newTestGitlab(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != testGitlabTreePath {
+					t.Errorf("Unexpect request %s", r.URL.Path)
+					http.NotFound(w, r)
+					return
+				}
+				query := r.URL.Query()
+				if query.Get("per_page") != strconv.Itoa(gitlabMaxPerPage) || query.Get("path") != "docs" {
+					t.Errorf("Unexpect tree query %q", r.URL.RawQuery)
+				}
+				page, _ := strconv.Atoi(query.Get("page"))
+				pages = append(pages, query.Get("page"))
+
+				// 5 nodes in 3 pages.
+				var nodes []map[string]interface{}
+				for i := (page - 1) * 2; i < page*2 && i < 5; i++ {
+					name := fmt.Sprintf("dir-%d", i)
+					nodes = append(nodes, map[string]interface{}{
+						"id": "t", "name": name, "type": "tree", "path": "docs/" + name, "mode": "040000",
+					})
+				}
+				if page < 3 {
+					w.Header().Set("X-Next-Page", strconv.Itoa(page+1))
+				}
+				if testCase.total != "" {
+					w.Header().Set("X-Total", testCase.total)
+				}
+				json.NewEncoder(w).Encode(nodes)
+			}))
+
+			ents, err := p.ReadDir(context.Background(), "docs")
+			if strings.Join(pages, ",") != "1,2,3" {
+				t.Fatalf("Expect all pages to be listed, got %v", pages)
+			}
+			if testCase.err {
+				if err == nil || !strings.Contains(err.Error(), "incomplete") {
+					t.Fatalf("Expect incomplete error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ents) != 5 || ents[4].Path != "docs/dir-4" {
+				t.Fatalf("Unexpect entries %+v", ents)
+			}
+		})
+	}
+}
+
+func TestGitlabReadSizes(t *testing.T) {
+	var mu sync.Mutex
+	var batches []int
+	var metas atomic.Int32
+	p := newTestGitlab(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/graphql":
+			var req graphQLRequest
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				t.Errorf("Decode graphql request error: %v", err)
+			}
+			if req.Variables["ref"] != "abc" || req.Variables["project"] != "fioncat/grfs" {
+				t.Errorf("Unexpect graphql variables %v", req.Variables)
+			}
+			paths, _ := req.Variables["paths"].([]interface{})
+			mu.Lock()
+			batches = append(batches, len(paths))
+			mu.Unlock()
+
+			// The second batch fails, all its files fallback.
+			if len(paths) < gitlabGraphQLBatch {
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"errors": []map[string]string{{"message": "something wrong"}},
+				})
+				return
+			}
+			var nodes []map[string]interface{}
+			for i, path := range paths {
+				// A file is missed by GraphQL.
+				if path == "file-7" {
+					continue
+				}
+				// The BigInt size might be encoded as a string.
+				var size interface{} = i
+				if i%2 == 0 {
+					size = strconv.Itoa(i)
+				}
+				nodes = append(nodes, map[string]interface{}{"path": path, "size": size})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{
+					"project": map[string]interface{}{
+						"repository": map[string]interface{}{
+							"blobs": map[string]interface{}{"nodes": nodes},
+						},
+					},
+				},
+			})
+
+		case strings.HasPrefix(r.URL.Path, "/api/v4/projects/fioncat/grfs/repository/files/"):
+			metas.Add(1)
+			if r.Method != http.MethodHead || r.URL.Query().Get("ref") != "abc" {
+				t.Errorf("Unexpect file meta request %s %q", r.Method, r.URL.RawQuery)
+			}
+			name := strings.TrimPrefix(r.URL.Path, "/api/v4/projects/fioncat/grfs/repository/files/")
+			index, _ := strconv.Atoi(strings.TrimPrefix(name, "file-"))
+			w.Header().Set("X-Gitlab-Size", strconv.Itoa(index))
+
+		default:
+			t.Errorf("Unexpect request %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+
+	ents := []*types.Entry{{Path: "dir", IsDir: true}}
+	for i := 0; i < gitlabGraphQLBatch+50; i++ {
+		ents = append(ents, &types.Entry{Path: fmt.Sprintf("file-%d", i)})
+	}
+	err := p.ReadSizes(context.Background(), ents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batches) != 2 || batches[0]+batches[1] != gitlabGraphQLBatch+50 {
+		t.Fatalf("Expect files to be queried in 2 batches, got %v", batches)
+	}
+	// The missed file and the failed batch.
+	if n := metas.Load(); n != 51 {
+		t.Fatalf("Expect 51 file meta requests, got %d", n)
+	}
+	for i, ent := range ents[1:] {
+		if ent.Size != int64(i) {
+			t.Fatalf("Unexpect size %d for %q", ent.Size, ent.Path)
+		}
+	}
+}
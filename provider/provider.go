@@ -1,23 +1,34 @@
 package provider
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/fioncat/grfs/types"
+	"golang.org/x/sync/errgroup"
 )
 
+// concurrentLimit is the max number of concurrent requests sent by one
+// provider call.
+const concurrentLimit = 8
+
 func Load(repo *types.Repository, cfg *types.Config) (types.Provider, error) {
 	var token string
 	if cfg.Auths != nil {
 		token = cfg.Auths[repo.Domain]
 	}
 
+	limiter := getRateLimiter(repo.Domain, cfg.Fs.RateLimitWait)
+
 	var prov types.Provider
 	var err error
 	if repo.IsGithub() {
-		prov = newGithub(repo, token)
+		prov = newGithub(repo, token, limiter, cfg.Retry)
 	} else {
-		prov, err = newGitlab(repo, token)
+		prov, err = newGitlab(repo, token, limiter, cfg.Retry)
 		if err != nil {
 			return nil, fmt.Errorf("init gitlab api: %w", err)
 		}
@@ -25,3 +36,99 @@ func Load(repo *types.Repository, cfg *types.Config) (types.Provider, error) {
 
 	return prov, nil
 }
+
+// sliceRangeResponse returns the requested range of data. The server might
+// ignore the Range header and return the whole content with status 200, in
+// which case we cut the range ourselves.
+func sliceRangeResponse(data []byte, status int, off, length int64) []byte {
+	if status == http.StatusPartialContent {
+		return data
+	}
+
+	size := int64(len(data))
+	if off >= size {
+		return nil
+	}
+	end := off + length
+	if end > size {
+		end = size
+	}
+	return data[off:end]
+}
+
+// escapePath escapes each segment of path to be put into url path, the go-github
+// client does not escape the path parameters.
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func formatRangeHeader(off, length int64) string {
+	return fmt.Sprintf("bytes=%d-%d", off, off+length-1)
+}
+
+type graphQLRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+type graphQLError struct {
+	Message string `json:"message"`
+}
+
+// runConcurrent calls fn for each index in [0, count) with bounded
+// concurrency, and returns the first error.
+func runConcurrent(ctx context.Context, count int, fn func(ctx context.Context, i int) error) error {
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(concurrentLimit)
+	for i := 0; i < count; i++ {
+		i := i
+		group.Go(func() error {
+			return fn(ctx, i)
+		})
+	}
+	return group.Wait()
+}
+
+// readCommitsByPath reads the last commits of paths by read concurrently,
+// which costs a request per path. It is skipped when the rate limit budget is
+// low, see rateLimiter.checkBudget.
+func readCommitsByPath(ctx context.Context, limiter *rateLimiter, paths []string,
+	read func(ctx context.Context, path string) (*types.Commit, error)) (map[string]*types.Commit, error) {
+	err := limiter.checkBudget(len(paths))
+	if err != nil {
+		return nil, err
+	}
+
+	commits := make([]*types.Commit, len(paths))
+	err = runConcurrent(ctx, len(paths), func(ctx context.Context, i int) error {
+		// The budget might be used by other calls meanwhile.
+		err := limiter.checkBudget(1)
+		if err != nil {
+			return err
+		}
+		commits[i], err = read(ctx, paths[i])
+		if err != nil {
+			return fmt.Errorf("list commits for %q: %w", paths[i], err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return collectCommits(paths, commits), nil
+}
+
+func collectCommits(paths []string, commits []*types.Commit) map[string]*types.Commit {
+	result := make(map[string]*types.Commit, len(paths))
+	for i, path := range paths {
+		if commits[i] != nil {
+			result[path] = commits[i]
+		}
+	}
+	return result
+}
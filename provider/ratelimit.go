@@ -0,0 +1,305 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fioncat/grfs/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// rateLimitThrottleRatio is the ratio of the remaining budget to the
+	// limit, below which the requests are spread out until the reset.
+	rateLimitThrottleRatio = 0.1
+	// rateLimitMaxDelay caps the delay of a throttled request.
+	rateLimitMaxDelay = time.Second * 10
+	// rateLimitDefaultWait is the wait time of a rejected request, when the
+	// server does not tell the reset time.
+	rateLimitDefaultWait = time.Minute
+)
+
+// rateLimiter tracks the rate limit budget of a domain, which is shared by
+// all the providers of the domain, since they use the same token.
+type rateLimiter struct {
+	domain string
+
+	// wait blocks requests until the reset when the budget is exhausted,
+	// rather than failing with types.ErrRateLimited.
+	wait bool
+
+	limit     int
+	remaining int
+	reset     time.Time
+	known     bool
+
+	// lowWarned is set after warning the low budget in current window.
+	lowWarned bool
+
+	mu sync.Mutex
+}
+
+var (
+	rateLimiters   = make(map[string]*rateLimiter)
+	rateLimitersMu sync.Mutex
+)
+
+func getRateLimiter(domain string, wait bool) *rateLimiter {
+	rateLimitersMu.Lock()
+	defer rateLimitersMu.Unlock()
+
+	limiter, ok := rateLimiters[domain]
+	if !ok {
+		limiter = &rateLimiter{domain: domain, wait: wait}
+		rateLimiters[domain] = limiter
+	}
+	return limiter
+}
+
+// RateLimit returns the snapshot of the budget, nil if no response with the
+// rate limit headers was received yet.
+func (l *rateLimiter) RateLimit() *types.RateLimit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.known {
+		return nil
+	}
+	return &types.RateLimit{
+		Limit:     l.limit,
+		Remaining: l.remaining,
+		Reset:     l.reset.Unix(),
+	}
+}
+
+// before is called before sending each request. It delays the request when
+// the budget is low, and waits or fails when the budget is exhausted.
+func (l *rateLimiter) before(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		if !l.known || !now.Before(l.reset) {
+			l.mu.Unlock()
+			return nil
+		}
+
+		untilReset := l.reset.Sub(now)
+		if l.remaining <= 0 {
+			reset := l.reset
+			l.mu.Unlock()
+			if !l.wait {
+				return fmt.Errorf("%w: %s resets at %s", types.ErrRateLimited,
+					l.domain, reset.Format(time.TimeOnly))
+			}
+			logrus.Infof("Wait rate limit of %s to reset at %s", l.domain, reset.Format(time.TimeOnly))
+			err := sleepContext(ctx, untilReset)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		var delay time.Duration
+		if float64(l.remaining) < float64(l.limit)*rateLimitThrottleRatio {
+			delay = untilReset / time.Duration(l.remaining+1)
+			if delay > rateLimitMaxDelay {
+				delay = rateLimitMaxDelay
+			}
+		}
+		// Reserve the budget, the concurrent requests should see it before
+		// the response headers update it.
+		l.remaining--
+		l.mu.Unlock()
+
+		if delay > 0 {
+			logrus.Debugf("Throttle request to %s for %v", l.domain, delay)
+			return sleepContext(ctx, delay)
+		}
+		return nil
+	}
+}
+
+// checkBudget returns types.ErrRateLimited if sending n requests would make
+// the budget low. It guards the optional requests sent for each path, so that
+// the budget is kept for reading files and directories.
+func (l *rateLimiter) checkBudget(n int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.known || !time.Now().Before(l.reset) {
+		return nil
+	}
+	if float64(l.remaining-n) < float64(l.limit)*rateLimitThrottleRatio {
+		return fmt.Errorf("%w: %d/%d remaining of %s, not enough for %d requests", types.ErrRateLimited,
+			l.remaining, l.limit, l.domain, n)
+	}
+	return nil
+}
+
+// update records the budget from the response headers, and reports whether
+// the request was rejected for rate limit.
+func (l *rateLimiter) update(resp *http.Response) bool {
+	// GitHub counts the GraphQL requests in a separate budget, which should
+	// not affect the budget of REST API.
+	if resource := resp.Header.Get("X-RateLimit-Resource"); resource != "" && resource != "core" {
+		return false
+	}
+
+	limit, hasLimit := getRateLimitHeader(resp.Header, "Limit")
+	remaining, hasRemaining := getRateLimitHeader(resp.Header, "Remaining")
+	reset, hasReset := getRateLimitHeader(resp.Header, "Reset")
+
+	limited := resp.StatusCode == http.StatusTooManyRequests ||
+		(resp.StatusCode == http.StatusForbidden && hasRemaining && remaining == 0)
+	if _, ok := getSecondaryRateLimit(resp); ok {
+		// The request is retried by retryTransport, the budget of the domain
+		// is not exhausted.
+		limited = false
+	}
+
+	var retryAfter time.Time
+	if limited {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			retryAfter = time.Now().Add(time.Duration(seconds) * time.Second)
+		}
+	}
+
+	if !limited && !(hasLimit && hasRemaining && hasReset) {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if hasLimit && hasRemaining && hasReset {
+		resetTime := time.Unix(int64(reset), 0)
+		if resetTime.After(l.reset) {
+			l.lowWarned = false
+		}
+		l.limit, l.remaining, l.reset = limit, remaining, resetTime
+		l.known = true
+	}
+	if limited {
+		if retryAfter.After(l.reset) {
+			l.reset = retryAfter
+		}
+		if !l.reset.After(time.Now()) {
+			l.reset = time.Now().Add(rateLimitDefaultWait)
+		}
+		l.remaining = 0
+		l.known = true
+		logrus.Warnf("Rate limit of %s exhausted, reset at %s", l.domain, l.reset.Format(time.TimeOnly))
+		return true
+	}
+
+	logrus.Debugf("Rate limit of %s: %d/%d remaining, reset at %s", l.domain,
+		l.remaining, l.limit, l.reset.Format(time.TimeOnly))
+	if !l.lowWarned && float64(l.remaining) < float64(l.limit)*rateLimitThrottleRatio {
+		l.lowWarned = true
+		logrus.Warnf("Rate limit budget of %s is low, %d/%d remaining, reset at %s, throttle requests",
+			l.domain, l.remaining, l.limit, l.reset.Format(time.TimeOnly))
+	}
+	return false
+}
+
+// getSecondaryRateLimit returns the delay required by a secondary rate limit,
+// such as the abuse detection of GitHub. It is reported by "Retry-After",
+// while the primary budget is not exhausted.
+func getSecondaryRateLimit(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	if remaining, ok := getRateLimitHeader(resp.Header, "Remaining"); ok && remaining == 0 {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// getRateLimitHeader reads the GitHub style "X-RateLimit-*" or the GitLab style
+// "RateLimit-*" header.
+func getRateLimitHeader(header http.Header, name string) (int, bool) {
+	value := header.Get("X-RateLimit-" + name)
+	if value == "" {
+		value = header.Get("RateLimit-" + name)
+	}
+	if value == "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimitTransport is the http transport of provider clients, which gates
+// the requests by the rate limiter.
+type rateLimitTransport struct {
+	limiter *rateLimiter
+	base    http.RoundTripper
+
+	// hideHeaders removes the rate limit headers after tracking. go-github
+	// refuses requests on its own once it sees an exhausted budget, before
+	// the transport could wait for the reset.
+	hideHeaders bool
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for {
+		err := t.limiter.before(req.Context())
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		limited := t.limiter.update(resp)
+		if t.hideHeaders {
+			for _, prefix := range []string{"X-RateLimit-", "RateLimit-"} {
+				for _, name := range []string{"Limit", "Remaining", "Reset", "Used", "Resource"} {
+					resp.Header.Del(prefix + name)
+				}
+			}
+		}
+		if !limited {
+			return resp, nil
+		}
+
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		// The request is sent again after the reset in wait mode, which
+		// requires rewinding its body.
+		if !t.limiter.wait || (req.Body != nil && req.GetBody == nil) {
+			return nil, fmt.Errorf("%w: %s %s", types.ErrRateLimited, req.Method, req.URL.Path)
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("rewind request body: %w", err)
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fioncat/grfs/types"
+)
+
+func newRateLimitResponse(status int, headers map[string]string) *http.Response {
+	resp := &http.Response{
+		StatusCode: status,
+		Header:     make(http.Header),
+	}
+	for name, value := range headers {
+		resp.Header.Set(name, value)
+	}
+	return resp
+}
+
+func TestRateLimiterUpdate(t *testing.T) {
+	reset := time.Now().Add(time.Hour).Truncate(time.Second)
+	resetValue := strconv.FormatInt(reset.Unix(), 10)
+
+	testCases := []struct {
+		name    string
+		status  int
+		headers map[string]string
+
+		limited   bool
+		known     bool
+		remaining int
+		// resetAfter is the min duration from now to the reset, when it is
+		// not the one in headers.
+		resetAfter time.Duration
+	}{
+		{
+			name:   "github",
+			status: http.StatusOK,
+			headers: map[string]string{
+				"X-RateLimit-Limit":     "5000",
+				"X-RateLimit-Remaining": "4999",
+				"X-RateLimit-Reset":     resetValue,
+				"X-RateLimit-Resource":  "core",
+			},
+			known:     true,
+			remaining: 4999,
+		},
+		{
+			name:   "gitlab",
+			status: http.StatusOK,
+			headers: map[string]string{
+				"RateLimit-Limit":     "2000",
+				"RateLimit-Remaining": "100",
+				"RateLimit-Reset":     resetValue,
+			},
+			known:     true,
+			remaining: 100,
+		},
+		{
+			name:   "github graphql",
+			status: http.StatusOK,
+			headers: map[string]string{
+				"X-RateLimit-Limit":     "5000",
+				"X-RateLimit-Remaining": "0",
+				"X-RateLimit-Reset":     resetValue,
+				"X-RateLimit-Resource":  "graphql",
+			},
+		},
+		{
+			name:    "no headers",
+			status:  http.StatusOK,
+			headers: map[string]string{},
+		},
+		{
+			name:   "invalid headers",
+			status: http.StatusOK,
+			headers: map[string]string{
+				"X-RateLimit-Limit":     "unknown",
+				"X-RateLimit-Remaining": "10",
+				"X-RateLimit-Reset":     resetValue,
+			},
+		},
+		{
+			name:   "exhausted",
+			status: http.StatusForbidden,
+			headers: map[string]string{
+				"X-RateLimit-Limit":     "5000",
+				"X-RateLimit-Remaining": "0",
+				"X-RateLimit-Reset":     resetValue,
+			},
+			limited: true,
+			known:   true,
+		},
+		{
+			name:   "forbidden with budget",
+			status: http.StatusForbidden,
+			headers: map[string]string{
+				"X-RateLimit-Limit":     "5000",
+				"X-RateLimit-Remaining": "10",
+				"X-RateLimit-Reset":     resetValue,
+			},
+			known:     true,
+			remaining: 10,
+		},
+		{
+			name:       "too many requests",
+			status:     http.StatusTooManyRequests,
+			headers:    map[string]string{},
+			limited:    true,
+			known:      true,
+			resetAfter: rateLimitDefaultWait - time.Second,
+		},
+		{
+			name:   "secondary rate limit",
+			status: http.StatusForbidden,
+			headers: map[string]string{
+				"Retry-After": "120",
+			},
+		},
+		{
+			name:   "secondary rate limit with budget",
+			status: http.StatusTooManyRequests,
+			headers: map[string]string{
+				"X-RateLimit-Limit":     "5000",
+				"X-RateLimit-Remaining": "10",
+				"X-RateLimit-Reset":     resetValue,
+				"Retry-After":           "120",
+			},
+			known:     true,
+			remaining: 10,
+		},
+		{
+			name:   "retry after the reset",
+			status: http.StatusTooManyRequests,
+			headers: map[string]string{
+				"RateLimit-Limit":     "2000",
+				"RateLimit-Remaining": "0",
+				"RateLimit-Reset":     resetValue,
+				"Retry-After":         "7200",
+			},
+			limited:    true,
+			known:      true,
+			resetAfter: time.Second * 7199,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			l := &rateLimiter{domain: "test"}
+			limited := l.update(newRateLimitResponse(testCase.status, testCase.headers))
+			if limited != testCase.limited {
+				t.Fatalf("Expect limited %v, got %v", testCase.limited, limited)
+			}
+
+			rateLimit := l.RateLimit()
+			if !testCase.known {
+				if rateLimit != nil {
+					t.Fatalf("Expect unknown rate limit, got %+v", rateLimit)
+				}
+				return
+			}
+			if rateLimit == nil {
+				t.Fatal("Expect known rate limit")
+			}
+			if rateLimit.Remaining != testCase.remaining {
+				t.Fatalf("Expect remaining %d, got %d", testCase.remaining, rateLimit.Remaining)
+			}
+			if testCase.resetAfter > 0 {
+				if until := time.Until(time.Unix(rateLimit.Reset, 0)); until < testCase.resetAfter {
+					t.Fatalf("Expect reset after %v, got %v", testCase.resetAfter, until)
+				}
+			} else if rateLimit.Reset != reset.Unix() {
+				t.Fatalf("Expect reset %d, got %d", reset.Unix(), rateLimit.Reset)
+			}
+		})
+	}
+}
+
+func TestRateLimiterBefore(t *testing.T) {
+	ctx := context.Background()
+
+	// Unknown or expired budget does not block.
+	l := &rateLimiter{domain: "test"}
+	if err := l.before(ctx); err != nil {
+		t.Fatal(err)
+	}
+	l = &rateLimiter{domain: "test", known: true, reset: time.Now().Add(-time.Second)}
+	if err := l.before(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The budget is reserved by each request.
+	l = &rateLimiter{domain: "test", known: true, limit: 100, remaining: 50, reset: time.Now().Add(time.Hour)}
+	start := time.Now()
+	if err := l.before(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if l.remaining != 49 {
+		t.Fatalf("Expect budget to be reserved, remaining %d", l.remaining)
+	}
+	if time.Since(start) > time.Millisecond*50 {
+		t.Fatal("Expect no delay when the budget is enough")
+	}
+
+	// Throttle the requests when the budget is low.
+	l = &rateLimiter{domain: "test", known: true, limit: 100, remaining: 4, reset: time.Now().Add(time.Millisecond * 500)}
+	start = time.Now()
+	if err := l.before(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*50 {
+		t.Fatalf("Expect request to be throttled, took %v", elapsed)
+	}
+	l.remaining = 1
+	timeoutCtx, cancel := context.WithTimeout(ctx, time.Millisecond*10)
+	defer cancel()
+	if err := l.before(timeoutCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expect throttled request to be interrupted, got %v", err)
+	}
+
+	// Fail mode.
+	reset := time.Now().Add(time.Millisecond * 100)
+	l = &rateLimiter{domain: "test", known: true, limit: 100, remaining: 0, reset: reset}
+	if err := l.before(ctx); !errors.Is(err, types.ErrRateLimited) {
+		t.Fatalf("Expect rate limited error, got %v", err)
+	}
+
+	// Wait mode.
+	l.wait = true
+	timeoutCtx, cancel = context.WithTimeout(ctx, time.Millisecond*10)
+	defer cancel()
+	if err := l.before(timeoutCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expect waiting request to be interrupted, got %v", err)
+	}
+	if err := l.before(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if time.Now().Before(reset) {
+		t.Fatal("Expect request to wait until reset")
+	}
+}
+
+func TestRateLimitTransport(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Remaining", "4000")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	}))
+	defer server.Close()
+
+	for _, wait := range []bool{false, true} {
+		requests.Store(0)
+		limiter := &rateLimiter{domain: "test", wait: wait}
+		client := &http.Client{Transport: &rateLimitTransport{
+			limiter:     limiter,
+			base:        http.DefaultTransport,
+			hideHeaders: true,
+		}}
+
+		resp, err := client.Get(server.URL)
+		if !wait {
+			if !errors.Is(err, types.ErrRateLimited) {
+				t.Fatalf("Expect rate limited error in fail mode, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if requests.Load() != 2 {
+			t.Fatalf("Expect request to be sent again after reset, sent %d", requests.Load())
+		}
+		if resp.Header.Get("X-RateLimit-Remaining") != "" {
+			t.Fatal("Expect rate limit headers to be hidden")
+		}
+		if rateLimit := limiter.RateLimit(); rateLimit == nil || rateLimit.Remaining != 4000 {
+			t.Fatalf("Unexpect rate limit %+v", rateLimit)
+		}
+	}
+}
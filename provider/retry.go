@@ -0,0 +1,109 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fioncat/grfs/types"
+	"github.com/sirupsen/logrus"
+)
+
+// retryTransport retries the requests failed by transient errors, with
+// exponential backoff and jitter. It stops retrying once the request context
+// is done, such as the FUSE request being interrupted. It wraps the
+// rateLimitTransport, so that every attempt is gated by the rate limiter.
+type retryTransport struct {
+	cfg  *types.RetryConfig
+	base http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		retryAfter, retry := t.shouldRetry(ctx, resp, err)
+		if !retry || attempt >= t.cfg.Attempts {
+			return resp, err
+		}
+		// The request body is consumed by the previous attempt.
+		if req.Body != nil && req.GetBody == nil {
+			return resp, err
+		}
+
+		delay := t.backoff(attempt)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		if time.Since(start)+delay > t.cfg.Deadline {
+			return resp, err
+		}
+
+		reason := err
+		if resp != nil {
+			reason = fmt.Errorf("status %s", resp.Status)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		logrus.Warnf("Retry request %s %s after %v, attempt %d/%d: %v", req.Method,
+			req.URL.Path, delay, attempt+1, t.cfg.Attempts, reason)
+
+		err = sleepContext(ctx, delay)
+		if err != nil {
+			return nil, err
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("rewind request body: %w", err)
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+	}
+}
+
+// shouldRetry reports whether the request failed by a transient error, and
+// the delay required by the "Retry-After" header. The network errors, 5xx
+// responses and secondary rate limits are retried. The exhausted budget is
+// left to the rate limiter, which waits for the reset or fails the request.
+func (t *retryTransport) shouldRetry(ctx context.Context, resp *http.Response, err error) (time.Duration, bool) {
+	if ctx.Err() != nil {
+		return 0, false
+	}
+	if err != nil {
+		return 0, !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) &&
+			!errors.Is(err, types.ErrRateLimited)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err != nil {
+			return 0, true
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	// The secondary rate limits are lifted soon, the request is retried if
+	// the delay fits in the deadline.
+	return getSecondaryRateLimit(resp)
+}
+
+// backoff returns the delay before the next attempt, it doubles for each
+// attempt with jitter in [delay/2, delay].
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	delay := t.cfg.MaxBackoff
+	if attempt < 32 {
+		if d := t.cfg.MinBackoff << (attempt - 1); d > 0 && d < delay {
+			delay = d
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,327 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fioncat/grfs/types"
+)
+
+type testTimeoutError struct{}
+
+func (testTimeoutError) Error() string   { return "i/o timeout" }
+func (testTimeoutError) Timeout() bool   { return true }
+func (testTimeoutError) Temporary() bool { return true }
+
+var _ net.Error = testTimeoutError{}
+
+func newTestRetryTransport(base http.RoundTripper) *retryTransport {
+	return &retryTransport{
+		cfg: &types.RetryConfig{
+			Attempts:   3,
+			MinBackoff: time.Millisecond,
+			MaxBackoff: time.Millisecond * 4,
+			Deadline:   time.Second,
+		},
+		base: base,
+	}
+}
+
+func TestRetryShouldRetry(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	testCases := []struct {
+		name    string
+		ctx     context.Context
+		status  int
+		headers map[string]string
+		err     error
+
+		retry      bool
+		retryAfter time.Duration
+	}{
+		{name: "ok", status: http.StatusOK},
+		{name: "not found", status: http.StatusNotFound},
+		{name: "internal error", status: http.StatusInternalServerError, retry: true},
+		{name: "bad gateway", status: http.StatusBadGateway, retry: true},
+		{name: "gateway timeout", status: http.StatusGatewayTimeout, retry: true},
+		{
+			name:       "unavailable with retry after",
+			status:     http.StatusServiceUnavailable,
+			headers:    map[string]string{"Retry-After": "3"},
+			retry:      true,
+			retryAfter: time.Second * 3,
+		},
+		{name: "forbidden", status: http.StatusForbidden},
+		{
+			name:       "secondary rate limit",
+			status:     http.StatusForbidden,
+			headers:    map[string]string{"Retry-After": "3"},
+			retry:      true,
+			retryAfter: time.Second * 3,
+		},
+		{
+			name:       "too many requests",
+			status:     http.StatusTooManyRequests,
+			headers:    map[string]string{"Retry-After": "3"},
+			retry:      true,
+			retryAfter: time.Second * 3,
+		},
+		{
+			name:   "budget exhausted",
+			status: http.StatusTooManyRequests,
+			headers: map[string]string{
+				"RateLimit-Remaining": "0",
+				"Retry-After":         "3",
+			},
+		},
+		{name: "network error", err: testTimeoutError{}, retry: true},
+		{name: "connection reset", err: errors.New("connection reset by peer"), retry: true},
+		{name: "rate limited", err: fmt.Errorf("%w: GET /repos", types.ErrRateLimited)},
+		{name: "deadline", err: context.DeadlineExceeded},
+		{name: "canceled request", ctx: canceled, status: http.StatusBadGateway},
+	}
+
+	transport := newTestRetryTransport(nil)
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctx := testCase.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			var resp *http.Response
+			if testCase.err == nil {
+				resp = newRateLimitResponse(testCase.status, testCase.headers)
+			}
+			retryAfter, retry := transport.shouldRetry(ctx, resp, testCase.err)
+			if retry != testCase.retry || retryAfter != testCase.retryAfter {
+				t.Fatalf("Expect retry %v after %v, got %v after %v", testCase.retry,
+					testCase.retryAfter, retry, retryAfter)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	transport := &retryTransport{cfg: &types.RetryConfig{
+		MinBackoff: time.Millisecond * 100,
+		MaxBackoff: time.Second,
+	}}
+	testCases := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, time.Millisecond * 100},
+		{2, time.Millisecond * 200},
+		{3, time.Millisecond * 400},
+		{4, time.Millisecond * 800},
+		{5, time.Second},
+		{64, time.Second},
+	}
+	for _, testCase := range testCases {
+		for i := 0; i < 20; i++ {
+			delay := transport.backoff(testCase.attempt)
+			if delay < testCase.max/2 || delay > testCase.max {
+				t.Fatalf("Expect backoff of attempt %d in [%v, %v], got %v", testCase.attempt,
+					testCase.max/2, testCase.max, delay)
+			}
+		}
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	var requests atomic.Int32
+	// failures is the number of requests failed before succeeding.
+	var failures atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		data, _ := io.ReadAll(r.Body)
+		if r.Method == http.MethodPost && string(data) != "body" {
+			t.Errorf("Expect request body to be rewound, got %q", data)
+		}
+		if n <= failures.Load() {
+			w.Header().Set("Retry-After", r.URL.Query().Get("after"))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		name     string
+		method   string
+		after    string
+		failures int32
+		deadline time.Duration
+
+		requests int32
+		status   int
+	}{
+		{name: "success", failures: 0, requests: 1, status: http.StatusOK},
+		{name: "retried", failures: 2, requests: 3, status: http.StatusOK},
+		{name: "post", method: http.MethodPost, failures: 1, requests: 2, status: http.StatusOK},
+		{name: "attempts exhausted", failures: 5, requests: 3, status: http.StatusServiceUnavailable},
+		{
+			name:     "deadline exceeded",
+			after:    "2",
+			failures: 5,
+			requests: 1,
+			status:   http.StatusServiceUnavailable,
+		},
+		{
+			name:     "short deadline",
+			failures: 5,
+			deadline: time.Microsecond,
+			requests: 1,
+			status:   http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			requests.Store(0)
+			failures.Store(testCase.failures)
+			transport := newTestRetryTransport(http.DefaultTransport)
+			if testCase.deadline > 0 {
+				transport.cfg.Deadline = testCase.deadline
+			}
+			client := &http.Client{Transport: transport}
+
+			method := testCase.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req, err := http.NewRequest(method, server.URL+"?after="+testCase.after, strings.NewReader("body"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != testCase.status {
+				t.Fatalf("Expect status %d, got %d", testCase.status, resp.StatusCode)
+			}
+			if n := requests.Load(); n != testCase.requests {
+				t.Fatalf("Expect %d requests, got %d", testCase.requests, n)
+			}
+		})
+	}
+}
+
+func TestRetryTransportInterrupted(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	transport := newTestRetryTransport(http.DefaultTransport)
+	transport.cfg.MinBackoff, transport.cfg.MaxBackoff = time.Second, time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = transport.RoundTrip(req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expect interrupted error, got %v", err)
+	}
+	if requests.Load() != 1 {
+		t.Fatalf("Expect no retry after interrupted, got %d requests", requests.Load())
+	}
+}
+
+func TestRetryRateLimited(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		query := r.URL.Query()
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Remaining", query.Get("remaining"))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+		if n == 1 || query.Get("remaining") == "0" {
+			w.Header().Set("Retry-After", query.Get("after"))
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		name      string
+		remaining string
+		after     string
+
+		// requests is the number of requests sent by two calls.
+		requests int32
+		status   int
+		limited  bool
+	}{
+		{name: "secondary", remaining: "4000", after: "1", requests: 3, status: http.StatusOK},
+		{
+			name:      "secondary after deadline",
+			remaining: "4000",
+			after:     "60",
+			requests:  2,
+			status:    http.StatusForbidden,
+		},
+		{name: "exhausted", remaining: "0", after: "1", requests: 1, limited: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			requests.Store(0)
+			// The same chain as providers, the retries are gated by the rate
+			// limiter.
+			limiter := &rateLimiter{domain: "test"}
+			transport := newTestRetryTransport(&rateLimitTransport{
+				limiter: limiter,
+				base:    http.DefaultTransport,
+			})
+			transport.cfg.Deadline = time.Second * 5
+			client := &http.Client{Transport: transport}
+
+			url := fmt.Sprintf("%s?remaining=%s&after=%s", server.URL, testCase.remaining, testCase.after)
+			for i := 0; i < 2; i++ {
+				resp, err := client.Get(url)
+				if testCase.limited {
+					if !errors.Is(err, types.ErrRateLimited) {
+						t.Fatalf("Expect rate limited error, got %v", err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if i == 0 && resp.StatusCode != testCase.status {
+					t.Fatalf("Expect status %d, got %d", testCase.status, resp.StatusCode)
+				}
+			}
+			if n := requests.Load(); n != testCase.requests {
+				t.Fatalf("Expect %d requests, got %d", testCase.requests, n)
+			}
+
+			// Only the exhausted budget blocks the domain.
+			rateLimit := limiter.RateLimit()
+			if exhausted := rateLimit != nil && rateLimit.Remaining == 0; exhausted != testCase.limited {
+				t.Fatalf("Expect exhausted %v, got rate limit %+v", testCase.limited, rateLimit)
+			}
+		})
+	}
+}
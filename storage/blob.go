@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fioncat/grfs/osutils"
+	"github.com/fioncat/grfs/types"
+	"github.com/sirupsen/logrus"
+)
+
+type diskBlobCache struct {
+	dir string
+
+	maxSize int64
+
+	// size is the total size of blobs we know, it is refreshed every time
+	// we do eviction, since other daemons might write to the same directory.
+	size int64
+	mu   sync.Mutex
+
+	// evicting is set while an eviction scan is running, so that concurrent
+	// Puts do not start another scan of the whole directory.
+	evicting bool
+}
+
+func OpenBlobCache(cfg *types.Config) (types.BlobCache, error) {
+	if cfg.Cache == nil || cfg.Cache.Disable {
+		return nil, nil
+	}
+
+	dir := filepath.Join(cfg.BaseDir, "cache", "blobs")
+	err := osutils.EnsureDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("ensure blob cache dir: %w", err)
+	}
+
+	c := &diskBlobCache{
+		dir:     dir,
+		maxSize: int64(cfg.Cache.MaxSize),
+	}
+
+	files, err := c.listFiles()
+	if err != nil {
+		return nil, fmt.Errorf("scan blob cache dir: %w", err)
+	}
+	for _, file := range files {
+		c.size += file.size
+	}
+
+	return c, nil
+}
+
+func (c *diskBlobCache) Get(key string) ([]byte, bool, error) {
+	path := c.getPath(key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("read blob cache file: %w", err)
+	}
+
+	// The modification time is used as the last access time for eviction.
+	now := time.Now()
+	err = os.Chtimes(path, now, now)
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("Touch blob cache file %q error: %v", path, err)
+	}
+
+	return data, true, nil
+}
+
+func (c *diskBlobCache) Put(key string, data []byte) error {
+	size := int64(len(data))
+	if size > c.maxSize {
+		return nil
+	}
+
+	path := c.getPath(key)
+	err := osutils.EnsureFilePathDir(path)
+	if err != nil {
+		return fmt.Errorf("ensure blob cache dir: %w", err)
+	}
+
+	// Write to a temporary file first and then rename it, so that other
+	// daemons sharing the cache never see partial blobs.
+	tmp, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create blob cache temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("write blob cache temp file: %w", err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("close blob cache temp file: %w", err)
+	}
+
+	c.mu.Lock()
+	// Overwriting an existing blob replaces its size instead of adding to it.
+	var oldSize int64
+	info, err := os.Stat(path)
+	if err == nil {
+		oldSize = info.Size()
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		c.mu.Unlock()
+		return fmt.Errorf("rename blob cache file: %w", err)
+	}
+	c.size += size - oldSize
+	needEvict := c.size > c.maxSize && !c.evicting
+	if needEvict {
+		c.evicting = true
+	}
+	start := c.size
+	c.mu.Unlock()
+
+	if !needEvict {
+		return nil
+	}
+	// The directory scan runs without the lock, so that other Puts are not
+	// blocked by it.
+	size, err = c.evict()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evicting = false
+	if err != nil {
+		return err
+	}
+	// Keep the blobs written by other Puts during the scan.
+	c.size = size + c.size - start
+	return nil
+}
+
+type blobCacheFile struct {
+	path  string
+	size  int64
+	mtime time.Time
+}
+
+func (c *diskBlobCache) evict() (int64, error) {
+	files, err := c.listFiles()
+	if err != nil {
+		return 0, fmt.Errorf("scan blob cache dir: %w", err)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].mtime.Before(files[j].mtime)
+	})
+
+	var size int64
+	for _, file := range files {
+		size += file.size
+	}
+
+	var evicted int
+	for _, file := range files {
+		if size <= c.maxSize {
+			break
+		}
+		err = os.Remove(file.path)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, fmt.Errorf("remove blob cache file: %w", err)
+		}
+		size -= file.size
+		evicted++
+	}
+	logrus.Debugf("Evict %d blob(s) from cache, current size %d", evicted, size)
+
+	return size, nil
+}
+
+func (c *diskBlobCache) listFiles() ([]*blobCacheFile, error) {
+	var files []*blobCacheFile
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || filepath.Dir(path) == c.dir {
+			// Skip directories and temporary files in the root.
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		files = append(files, &blobCacheFile{
+			path:  path,
+			size:  info.Size(),
+			mtime: info.ModTime(),
+		})
+		return nil
+	})
+	return files, err
+}
+
+func (c *diskBlobCache) getPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(c.dir, name[:2], name)
+}
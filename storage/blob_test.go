@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fioncat/grfs/types"
+)
+
+func TestBlobCache(t *testing.T) {
+	err := os.RemoveAll("_test/cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &types.Config{
+		BaseDir: "_test",
+		Cache: &types.CacheConfig{
+			MaxSize: 100,
+		},
+	}
+	cache, err := OpenBlobCache(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, ok, err := cache.Get("blob/not-exists")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("Expect cache miss for not exists key")
+	}
+
+	count := 5
+	for i := 0; i < count; i++ {
+		data := []byte(fmt.Sprintf("%020d", i))
+		err = cache.Put(fmt.Sprintf("blob/%d", i), data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Make sure every blob has different modification time
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	for i := 0; i < count; i++ {
+		var data []byte
+		data, ok, err = cache.Get(fmt.Sprintf("blob/%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("Expect cache hit for blob %d", i)
+		}
+		expect := []byte(fmt.Sprintf("%020d", i))
+		if !reflect.DeepEqual(data, expect) {
+			t.Fatalf("Unexpect blob data %q, expect %q", string(data), string(expect))
+		}
+		// Get refreshes the modification time, keep the order of blobs
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// The cache was full, the oldest one should be evicted
+	err = cache.Put("blob/new", []byte("new blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok, err = cache.Get("blob/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("Expect blob 0 to be evicted")
+	}
+
+	// Reopen the cache, the blobs should survive
+	cache, err = OpenBlobCache(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, ok, err := cache.Get("blob/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || string(data) != "new blob" {
+		t.Fatalf("Unexpect blob after reopen: %q, %v", string(data), ok)
+	}
+}
+
+func TestBlobCacheOverwrite(t *testing.T) {
+	err := os.RemoveAll("_test/cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &types.Config{
+		BaseDir: "_test",
+		Cache: &types.CacheConfig{
+			MaxSize: 100,
+		},
+	}
+	cache, err := OpenBlobCache(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		err = cache.Put("blob/same", []byte(fmt.Sprintf("%020d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	size := cache.(*diskBlobCache).size
+	if size != 20 {
+		t.Fatalf("Unexpect cache size %d after overwrite, expect 20", size)
+	}
+}
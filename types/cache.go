@@ -0,0 +1,26 @@
+package types
+
+import "fmt"
+
+// BlobCache stores file contents outside of the daemon process, so that
+// they can be shared by all mountpoints and survive restarts.
+type BlobCache interface {
+	Get(key string) ([]byte, bool, error)
+	Put(key string, data []byte) error
+}
+
+// BlobCacheKey returns the cache key for a file entry. Blobs are addressed by
+// their git object id when it is known, which is immutable and can be shared
+// between repositories and refs. Otherwise, fallback to repo, revision and
+// path.
+// An empty key means the entry cannot be cached.
+func BlobCacheKey(repo *Repository, ent *Entry) string {
+	if ent.SHA != "" {
+		return fmt.Sprintf("blob/%s", ent.SHA)
+	}
+	rev := repo.Revision()
+	if rev == "" {
+		return ""
+	}
+	return fmt.Sprintf("path/%s:%s@%s/%s", repo.Domain, repo.Path(), rev, ent.Path)
+}
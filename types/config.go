@@ -2,10 +2,13 @@ package types
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/fioncat/grfs/osutils"
 	"gopkg.in/yaml.v3"
 )
@@ -16,6 +19,38 @@ const (
 
 	configDefaultOpenBoltTimeout = time.Second * 3
 	configDefaultFsTimeout       = time.Second * 10
+	configDefaultDirCacheTTL     = time.Minute
+
+	configDefaultReadDirTimeout  = time.Minute
+	configDefaultReadFileTimeout = time.Minute * 5
+	configDefaultReadTreeTimeout = time.Minute * 10
+
+	configDefaultCacheMaxSize = Size(1 << 30)
+
+	configDefaultRangeReadThreshold = Size(8 << 20)
+	configDefaultChunkSize          = Size(1 << 20)
+	configDefaultChunkCacheSize     = Size(64 << 20)
+
+	configDefaultMemoryLimit = Size(256 << 20)
+
+	configDefaultPrefetchWorkers  = 4
+	configDefaultPrefetchFileSize = Size(64 << 10)
+
+	configDefaultControlDir = ".grfs"
+
+	configDefaultRetryAttempts   = 4
+	configDefaultRetryMinBackoff = time.Millisecond * 200
+	configDefaultRetryMaxBackoff = time.Second * 5
+	configDefaultRetryDeadline   = time.Second * 30
+)
+
+const (
+	// ModTimeMount uses the mount time as the modification time of entries.
+	ModTimeMount = "mount"
+	// ModTimeRef uses the commit time of the ref tip for all entries.
+	ModTimeRef = "ref"
+	// ModTimeCommit uses the time of the last commit touching each entry.
+	ModTimeCommit = "commit"
 )
 
 type Config struct {
@@ -26,6 +61,10 @@ type Config struct {
 
 	Fs *FilesystemConfig `yaml:"fs"`
 
+	Cache *CacheConfig `yaml:"cache"`
+
+	Retry *RetryConfig `yaml:"retry"`
+
 	Auths Auths `yaml:"auths"`
 }
 
@@ -35,9 +74,110 @@ type FilesystemConfig struct {
 	AllowOthers  bool          `yaml:"allowOthers"`
 	EntryTimeout time.Duration `yaml:"entryTimeout"`
 
+	// DirCacheTTL is how long the directory listings and their last commits
+	// are cached, after that they will be read from provider again to pick
+	// up upstream changes. Zero means the listings never expire.
+	DirCacheTTL time.Duration `yaml:"dirCacheTTL"`
+
+	// ReadDirTimeout and ReadFileTimeout bound the provider requests made
+	// by one FUSE operation, listing or looking up a directory, and opening
+	// or reading a file.
+	ReadDirTimeout  time.Duration `yaml:"readDirTimeout"`
+	ReadFileTimeout time.Duration `yaml:"readFileTimeout"`
+
+	// By default, the whole repository tree is loaded in one request if the
+	// provider supports it, rather than reading directories one by one.
+	DisableTreePrefetch bool `yaml:"disableTreePrefetch"`
+	// ReadTreeTimeout bounds the request loading the tree. It runs in
+	// background, the listings do not wait for it once it takes long.
+	ReadTreeTimeout time.Duration `yaml:"readTreeTimeout"`
+
+	// ModTime is the source of modification time of entries, it can be
+	// "mount", "ref" or "commit".
+	ModTime string `yaml:"modTime"`
+
+	// Files larger than RangeReadThreshold are read by chunks on demand,
+	// rather than downloading the whole content when opening, if the
+	// provider supports it.
+	RangeReadThreshold Size `yaml:"rangeReadThreshold"`
+	ChunkSize          Size `yaml:"chunkSize"`
+	ChunkCacheSize     Size `yaml:"chunkCacheSize"`
+
+	// MemoryLimit is the budget for file content buffers held in memory,
+	// the least recently used buffers are evicted when it is exceeded.
+	MemoryLimit Size `yaml:"memoryLimit"`
+
+	// PrefetchDepth is the number of directory levels below a listed
+	// directory, whose listings are fetched ahead of time in background. The
+	// files not larger than PrefetchFileSize are fetched into the blob cache
+	// as well. Zero disables prefetching.
+	PrefetchDepth    int  `yaml:"prefetchDepth"`
+	PrefetchWorkers  int  `yaml:"prefetchWorkers"`
+	PrefetchFileSize Size `yaml:"prefetchFileSize"`
+
+	// ControlDir is the name of the virtual directory in the mount root,
+	// which is used to inspect and control the running filesystem.
+	ControlDir string `yaml:"controlDir"`
+	// ControlWritable enables the writable control files, such as "refresh"
+	// and "checkout". Otherwise the filesystem is mounted read-only, and it
+	// can be refreshed by the control socket.
+	ControlWritable bool `yaml:"controlWritable"`
+
+	// MetricsAddr is the address for the daemon to serve Prometheus metrics,
+	// such as "127.0.0.1:9100". Empty means disabled. Since every mount has
+	// its own daemon, use port 0 to serve them on different ports, the port
+	// is shown in the daemon status.
+	MetricsAddr string `yaml:"metricsAddr"`
+
+	// RateLimitWait blocks the requests until the rate limit of the API is
+	// reset, rather than failing them with EAGAIN.
+	RateLimitWait bool `yaml:"rateLimitWait"`
+
 	Debug bool `yaml:"debug"`
 }
 
+type CacheConfig struct {
+	Disable bool `yaml:"disable"`
+	MaxSize Size `yaml:"maxSize"`
+}
+
+// RetryConfig controls retrying the provider requests failed by transient
+// errors, such as network errors and 5xx responses.
+type RetryConfig struct {
+	// Attempts is the max number of attempts of a request, 1 disables
+	// retrying.
+	Attempts int `yaml:"attempts"`
+
+	MinBackoff time.Duration `yaml:"minBackoff"`
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+
+	// Deadline bounds the total time of a request including retries.
+	Deadline time.Duration `yaml:"deadline"`
+}
+
+// Size is a byte size, it can be written as an integer or a human-readable
+// string such as "512MiB" in the config file.
+type Size int64
+
+func (s *Size) UnmarshalYAML(node *yaml.Node) error {
+	var value string
+	err := node.Decode(&value)
+	if err != nil {
+		return err
+	}
+
+	bytes, err := humanize.ParseBytes(value)
+	if err != nil {
+		return fmt.Errorf("parse size %q: %w", value, err)
+	}
+	*s = Size(bytes)
+	return nil
+}
+
+func (s Size) String() string {
+	return humanize.IBytes(uint64(s))
+}
+
 func LoadConfig() (*Config, error) {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
@@ -71,6 +211,9 @@ func LoadConfig() (*Config, error) {
 
 	decoder := yaml.NewDecoder(file)
 	var cfg Config
+	// Decode over the default filesystem config, so that the omitted fields
+	// can be told apart from the explicit zero values.
+	cfg.Fs = cfg.newDefaultFilesystem()
 	err = decoder.Decode(&cfg)
 	if err != nil {
 		return nil, fmt.Errorf("decode config yaml file: %w", err)
@@ -115,6 +258,8 @@ func newDefaultConfig(path, baseDir string) *Config {
 		Auths: make(Auths),
 	}
 	c.Fs = c.newDefaultFilesystem()
+	c.Cache = c.newDefaultCache()
+	c.Retry = c.newDefaultRetry()
 
 	return c
 }
@@ -146,6 +291,122 @@ func (c *Config) validate() error {
 	} else {
 		c.Fs.EntryTimeout = configDefaultFsTimeout
 	}
+	switch {
+	case c.Fs.DirCacheTTL < 0:
+		return fmt.Errorf("invalid fs.dirCacheTTL %v, it should >= 0", c.Fs.DirCacheTTL)
+	case c.Fs.DirCacheTTL > 0:
+		err := c.validateDuration(c.Fs.DirCacheTTL)
+		if err != nil {
+			return fmt.Errorf("invalid fs.dirCacheTTL: %w", err)
+		}
+	}
+	if c.Fs.ReadDirTimeout > 0 {
+		err := c.validateDuration(c.Fs.ReadDirTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid fs.readDirTimeout: %w", err)
+		}
+	} else {
+		c.Fs.ReadDirTimeout = configDefaultReadDirTimeout
+	}
+	if c.Fs.ReadFileTimeout > 0 {
+		err := c.validateDuration(c.Fs.ReadFileTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid fs.readFileTimeout: %w", err)
+		}
+	} else {
+		c.Fs.ReadFileTimeout = configDefaultReadFileTimeout
+	}
+	if c.Fs.ReadTreeTimeout > 0 {
+		err := c.validateDuration(c.Fs.ReadTreeTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid fs.readTreeTimeout: %w", err)
+		}
+	} else {
+		c.Fs.ReadTreeTimeout = configDefaultReadTreeTimeout
+	}
+	switch c.Fs.ModTime {
+	case "":
+		c.Fs.ModTime = ModTimeMount
+	case ModTimeMount, ModTimeRef, ModTimeCommit:
+	default:
+		return fmt.Errorf("invalid fs.modTime %q, it should be one of %q, %q and %q",
+			c.Fs.ModTime, ModTimeMount, ModTimeRef, ModTimeCommit)
+	}
+	if c.Fs.RangeReadThreshold <= 0 {
+		c.Fs.RangeReadThreshold = configDefaultRangeReadThreshold
+	}
+	if c.Fs.ChunkSize <= 0 {
+		c.Fs.ChunkSize = configDefaultChunkSize
+	}
+	if c.Fs.ChunkCacheSize <= 0 {
+		c.Fs.ChunkCacheSize = configDefaultChunkCacheSize
+	}
+	if c.Fs.MemoryLimit <= 0 {
+		c.Fs.MemoryLimit = configDefaultMemoryLimit
+	}
+	if c.Fs.PrefetchDepth < 0 {
+		return fmt.Errorf("invalid fs.prefetchDepth %d, it should >= 0", c.Fs.PrefetchDepth)
+	}
+	if c.Fs.PrefetchWorkers <= 0 {
+		c.Fs.PrefetchWorkers = configDefaultPrefetchWorkers
+	}
+	if c.Fs.PrefetchFileSize <= 0 {
+		c.Fs.PrefetchFileSize = configDefaultPrefetchFileSize
+	}
+	switch {
+	case c.Fs.ControlDir == "":
+		c.Fs.ControlDir = configDefaultControlDir
+	case c.Fs.ControlDir == ".", c.Fs.ControlDir == "..", strings.Contains(c.Fs.ControlDir, "/"):
+		return fmt.Errorf("invalid fs.controlDir %q, it should be a valid file name", c.Fs.ControlDir)
+	}
+	if c.Fs.MetricsAddr != "" {
+		_, _, err := net.SplitHostPort(c.Fs.MetricsAddr)
+		if err != nil {
+			return fmt.Errorf("invalid fs.metricsAddr %q: %w", c.Fs.MetricsAddr, err)
+		}
+	}
+
+	if c.Cache == nil {
+		c.Cache = c.newDefaultCache()
+	}
+	if c.Cache.MaxSize <= 0 {
+		c.Cache.MaxSize = configDefaultCacheMaxSize
+	}
+
+	if c.Retry == nil {
+		c.Retry = c.newDefaultRetry()
+	}
+	if c.Retry.Attempts <= 0 {
+		c.Retry.Attempts = configDefaultRetryAttempts
+	}
+	if c.Retry.MinBackoff > 0 {
+		err := c.validateDuration(c.Retry.MinBackoff)
+		if err != nil {
+			return fmt.Errorf("invalid retry.minBackoff: %w", err)
+		}
+	} else {
+		c.Retry.MinBackoff = configDefaultRetryMinBackoff
+	}
+	if c.Retry.MaxBackoff > 0 {
+		err := c.validateDuration(c.Retry.MaxBackoff)
+		if err != nil {
+			return fmt.Errorf("invalid retry.maxBackoff: %w", err)
+		}
+	} else {
+		c.Retry.MaxBackoff = configDefaultRetryMaxBackoff
+	}
+	if c.Retry.MinBackoff > c.Retry.MaxBackoff {
+		return fmt.Errorf("invalid retry.minBackoff %v, it should <= retry.maxBackoff %v",
+			c.Retry.MinBackoff, c.Retry.MaxBackoff)
+	}
+	if c.Retry.Deadline > 0 {
+		err := c.validateDuration(c.Retry.Deadline)
+		if err != nil {
+			return fmt.Errorf("invalid retry.deadline: %w", err)
+		}
+	} else {
+		c.Retry.Deadline = configDefaultRetryDeadline
+	}
 
 	return nil
 }
@@ -155,10 +416,45 @@ func (c *Config) newDefaultFilesystem() *FilesystemConfig {
 		AllowOthers:  false,
 		EntryTimeout: configDefaultFsTimeout,
 
+		DirCacheTTL: configDefaultDirCacheTTL,
+
+		ReadDirTimeout:  configDefaultReadDirTimeout,
+		ReadFileTimeout: configDefaultReadFileTimeout,
+		ReadTreeTimeout: configDefaultReadTreeTimeout,
+
+		ModTime: ModTimeMount,
+
+		RangeReadThreshold: configDefaultRangeReadThreshold,
+		ChunkSize:          configDefaultChunkSize,
+		ChunkCacheSize:     configDefaultChunkCacheSize,
+
+		MemoryLimit: configDefaultMemoryLimit,
+
+		PrefetchWorkers:  configDefaultPrefetchWorkers,
+		PrefetchFileSize: configDefaultPrefetchFileSize,
+
+		ControlDir: configDefaultControlDir,
+
 		Debug: false,
 	}
 }
 
+func (c *Config) newDefaultCache() *CacheConfig {
+	return &CacheConfig{
+		Disable: false,
+		MaxSize: configDefaultCacheMaxSize,
+	}
+}
+
+func (c *Config) newDefaultRetry() *RetryConfig {
+	return &RetryConfig{
+		Attempts:   configDefaultRetryAttempts,
+		MinBackoff: configDefaultRetryMinBackoff,
+		MaxBackoff: configDefaultRetryMaxBackoff,
+		Deadline:   configDefaultRetryDeadline,
+	}
+}
+
 func (c *Config) validateDuration(d time.Duration) error {
 	if d < configMinimalDuration {
 		return fmt.Errorf("duration %v is too small, it should >= %v", d, configMinimalDuration)
@@ -31,7 +31,23 @@ openBoltTimeout: "20s"
 fs:
   allowOthers: true
   entryTimeout: "120s"
+  dirCacheTTL: "5m"
+  readDirTimeout: "30s"
+  disableTreePrefetch: true
+  modTime: "commit"
+  chunkSize: "4MiB"
+  memoryLimit: 1073741824
+  prefetchDepth: 2
+  prefetchFileSize: "128KiB"
+  controlDir: .repo
+  metricsAddr: "127.0.0.1:9100"
+  rateLimitWait: true
   debug: true
+cache:
+  maxSize: "512MiB"
+retry:
+  attempts: 6
+  deadline: "1m"
 auths:
   github.com: "test-github-token"
   gitlab.com: "test-gitlab-token"
@@ -43,7 +59,45 @@ var testExpectConfig = &Config{
 	Fs: &FilesystemConfig{
 		AllowOthers:  true,
 		EntryTimeout: time.Minute * 2,
-		Debug:        true,
+
+		DirCacheTTL: time.Minute * 5,
+
+		ReadDirTimeout:  time.Second * 30,
+		ReadFileTimeout: time.Minute * 5,
+
+		DisableTreePrefetch: true,
+		ReadTreeTimeout:     time.Minute * 10,
+
+		ModTime: ModTimeCommit,
+
+		RangeReadThreshold: 8 << 20,
+		ChunkSize:          4 << 20,
+		ChunkCacheSize:     64 << 20,
+
+		MemoryLimit: 1 << 30,
+
+		PrefetchDepth:    2,
+		PrefetchWorkers:  4,
+		PrefetchFileSize: 128 << 10,
+
+		ControlDir: ".repo",
+
+		MetricsAddr: "127.0.0.1:9100",
+
+		RateLimitWait: true,
+
+		Debug: true,
+	},
+
+	Cache: &CacheConfig{
+		MaxSize: 512 << 20,
+	},
+
+	Retry: &RetryConfig{
+		Attempts:   6,
+		MinBackoff: time.Millisecond * 200,
+		MaxBackoff: time.Second * 5,
+		Deadline:   time.Minute,
 	},
 
 	Auths: Auths{
@@ -76,3 +130,39 @@ func TestLoadConfig(t *testing.T) {
 		t.Fatalf("Unexpect config %+v, expect %+v", cfg, testExpectConfig)
 	}
 }
+
+func TestLoadConfigDirCacheTTL(t *testing.T) {
+	path := "_test/config_ttl.yaml"
+	os.Setenv("GRFS_CONFIG_PATH", path)
+	os.Setenv("GRFS_BASE_PATH", "_test/basedir")
+
+	for _, c := range []struct {
+		yaml   string
+		expect time.Duration
+		err    bool
+	}{
+		{yaml: "fs:\n  debug: true\n", expect: configDefaultDirCacheTTL},
+		{yaml: "fs:\n  dirCacheTTL: \"0s\"\n", expect: 0},
+		{yaml: "fs:\n  dirCacheTTL: \"10s\"\n", expect: time.Second * 10},
+		{yaml: "fs:\n  dirCacheTTL: \"-1m\"\n", err: true},
+	} {
+		err := os.WriteFile(path, []byte(c.yaml), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cfg, err := LoadConfig()
+		if c.err {
+			if err == nil {
+				t.Fatalf("Expect error for %q", c.yaml)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Fs.DirCacheTTL != c.expect {
+			t.Fatalf("Unexpect dirCacheTTL %v for %q, expect %v", cfg.Fs.DirCacheTTL, c.yaml, c.expect)
+		}
+	}
+}
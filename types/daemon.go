@@ -0,0 +1,63 @@
+package types
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+)
+
+// FilesystemStats is the snapshot of the counters of a mounted filesystem.
+type FilesystemStats struct {
+	ReadDirs   int64 `json:"readDirs"`
+	ReadFiles  int64 `json:"readFiles"`
+	ReadRanges int64 `json:"readRanges"`
+
+	DownloadBytes int64 `json:"downloadBytes"`
+
+	CacheHits   int64 `json:"cacheHits"`
+	CacheMisses int64 `json:"cacheMisses"`
+
+	BufferSize     int64 `json:"bufferSize"`
+	ChunkCacheSize int64 `json:"chunkCacheSize"`
+
+	Errors int64 `json:"errors"`
+
+	// RateLimit is the budget of provider API, nil if unknown.
+	RateLimit *RateLimit `json:"rateLimit,omitempty"`
+}
+
+// DaemonController is implemented by the filesystem root, the daemon serves
+// its control socket with it.
+type DaemonController interface {
+	// Repository returns a copy of the mounted repository, with the current
+	// ref and commit.
+	Repository() *Repository
+	Stats() *FilesystemStats
+	Refresh(ctx context.Context) error
+	// Checkout switches the mounted repository to another ref.
+	Checkout(ctx context.Context, ref string) error
+}
+
+// DaemonStatus is the live information of a fuse daemon.
+type DaemonStatus struct {
+	PID       int   `json:"pid"`
+	StartTime int64 `json:"startTime"`
+
+	Repo  *Repository      `json:"repo"`
+	Stats *FilesystemStats `json:"stats"`
+
+	LogLevel string `json:"logLevel"`
+
+	// MetricsAddr is the address serving Prometheus metrics, empty if not
+	// served.
+	MetricsAddr string `json:"metricsAddr,omitempty"`
+}
+
+// GetSocketPath returns the path of the control socket for the daemon that
+// serves mountPath. The mount path is hashed to keep the socket path short.
+func GetSocketPath(baseDir, mountPath string) string {
+	sum := sha256.Sum256([]byte(mountPath))
+	name := hex.EncodeToString(sum[:])[:16] + ".sock"
+	return filepath.Join(baseDir, "sockets", name)
+}
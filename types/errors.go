@@ -0,0 +1,16 @@
+package types
+
+import "errors"
+
+// The errors returned by providers, the causes are wrapped with them, so
+// they should be checked with errors.Is.
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	// ErrRateLimited is returned when the rate limit budget of the API is
+	// exhausted.
+	ErrRateLimited = errors.New("rate limit exceeded")
+	ErrTooLarge    = errors.New("too large")
+	ErrTimeout     = errors.New("timeout")
+)
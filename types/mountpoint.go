@@ -58,6 +58,10 @@ type MountPointDisplay struct {
 	Status MountPointStatus `json:"status,omitempty"`
 
 	ErrorMessage string `json:"errMsg,omitempty"`
+
+	// Daemon is the live information from the control socket, only for the
+	// mounted mountpoints.
+	Daemon *DaemonStatus `json:"daemon,omitempty"`
 }
 
 type FilesystemMounter interface {
@@ -1,6 +1,32 @@
 package types
 
-import "context"
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// The git modes of tree entries.
+const (
+	GitModeTree       uint32 = 0040000
+	GitModeFile       uint32 = 0100644
+	GitModeExecutable uint32 = 0100755
+	GitModeSymlink    uint32 = 0120000
+	GitModeSubmodule  uint32 = 0160000
+)
+
+// ParseGitMode parses the octal git mode string, such as "100755".
+func ParseGitMode(s string) (uint32, error) {
+	if s == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("parse git mode %q: %w", s, err)
+	}
+	return uint32(mode), nil
+}
 
 type Entry struct {
 	Path string
@@ -13,12 +39,98 @@ type Entry struct {
 
 	Size int64
 
+	// Mode is the git mode of this entry, such as GitModeExecutable. It might
+	// be zero if the provider does not know it.
+	Mode uint32
+
+	// Submodule is not nil if this entry is a git submodule, it is treated
+	// as a directory.
+	Submodule *Submodule
+
+	// SHA is the git blob (or tree) object id of this entry, it might be
+	// empty if the provider does not know it.
+	SHA string
+
 	WebUrl string
 }
 
+type Submodule struct {
+	// URL is the clone url of the submodule repository, read from the
+	// ".gitmodules" file, might be relative to the parent repository.
+	URL string
+	// Commit is the commit SHA the submodule is pinned to.
+	Commit string
+}
+
 type Provider interface {
 	Check(ctx context.Context) error
 
 	ReadDir(ctx context.Context, path string) ([]*Entry, error)
 	ReadFile(ctx context.Context, path string) ([]byte, error)
 }
+
+// RangeReader is an optional interface for providers, which can read part of
+// a file without downloading the whole content.
+type RangeReader interface {
+	ReadFileRange(ctx context.Context, path string, off, length int64) ([]byte, error)
+}
+
+// LinkReader is an optional interface for providers, which read the targets
+// of symlinks on demand. The listings of such providers leave LinkName empty,
+// and set Size to the length of target.
+type LinkReader interface {
+	ReadLink(ctx context.Context, ent *Entry) (string, error)
+}
+
+// TreeReader is an optional interface for providers, which can read all the
+// entries of the repository in one request. If the tree is too large, the
+// provider returns truncated, and the caller should fallback to ReadDir.
+type TreeReader interface {
+	ReadTree(ctx context.Context) (ents []*Entry, truncated bool, err error)
+}
+
+// SizeReader is an optional interface for TreeReader providers, whose trees
+// leave the sizes of files zero, since reading them for the whole repository
+// is too expensive. The sizes of a directory are filled by ReadSizes when it
+// is listed from the tree.
+type SizeReader interface {
+	ReadSizes(ctx context.Context, ents []*Entry) error
+}
+
+type Commit struct {
+	SHA    string
+	Author string
+	Time   time.Time
+}
+
+// CommitReader is an optional interface for providers, which can read the
+// last commit touching each path at the current revision. The empty path
+// stands for the commit of revision itself.
+type CommitReader interface {
+	ReadLastCommits(ctx context.Context, paths []string) (map[string]*Commit, error)
+}
+
+// RefLister is an optional interface for providers, which can list the
+// branch and tag names of the repository.
+type RefLister interface {
+	ListBranches(ctx context.Context) ([]string, error)
+	ListTags(ctx context.Context) ([]string, error)
+}
+
+type RateLimit struct {
+	Limit     int `json:"limit"`
+	Remaining int `json:"remaining"`
+	// Reset is the unix time when the budget is reset.
+	Reset int64 `json:"reset"`
+}
+
+func (r *RateLimit) String() string {
+	return fmt.Sprintf("%d/%d, reset at %s", r.Remaining, r.Limit,
+		time.Unix(r.Reset, 0).Format(time.TimeOnly))
+}
+
+// RateLimitReporter is an optional interface for providers, which can report
+// the rate limit budget of the API. It returns nil if the budget is unknown.
+type RateLimitReporter interface {
+	RateLimit() *RateLimit
+}
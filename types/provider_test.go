@@ -0,0 +1,32 @@
+package types
+
+import "testing"
+
+func TestParseGitMode(t *testing.T) {
+	testCases := []struct {
+		str  string
+		mode uint32
+	}{
+		{"", 0},
+		{"040000", GitModeTree},
+		{"100644", GitModeFile},
+		{"100755", GitModeExecutable},
+		{"120000", GitModeSymlink},
+		{"160000", GitModeSubmodule},
+	}
+
+	for i, tc := range testCases {
+		mode, err := ParseGitMode(tc.str)
+		if err != nil {
+			t.Fatalf("Parse git mode error: %v, index %d", err, i)
+		}
+		if mode != tc.mode {
+			t.Fatalf("Unexpect git mode %o, expect %o, index %d", mode, tc.mode, i)
+		}
+	}
+
+	_, err := ParseGitMode("100999")
+	if err == nil {
+		t.Fatal("Expect error for invalid git mode")
+	}
+}
@@ -20,6 +20,17 @@ type Repository struct {
 	Name  string `json:"name"`
 
 	Ref string `json:"ref"`
+
+	// Commit is the commit SHA resolved from Ref. If it is not empty, all
+	// reads are pinned to it for a consistent snapshot, unless Follow is set.
+	Commit string `json:"commit,omitempty"`
+	// Follow means always reading the latest content of Ref, the Commit is
+	// only for display.
+	Follow bool `json:"follow,omitempty"`
+
+	// MultiRef mounts the branches, tags and commits of the repository
+	// under "@branches", "@tags" and "@commits", rather than only Ref.
+	MultiRef bool `json:"multiRef,omitempty"`
 }
 
 func (r *Repository) String() string {
@@ -30,6 +41,18 @@ func (r *Repository) String() string {
 	return base
 }
 
+func (r *Repository) IsPinned() bool {
+	return r.Commit != "" && !r.Follow
+}
+
+// Revision returns the revision to read the repository content from.
+func (r *Repository) Revision() string {
+	if r.IsPinned() {
+		return r.Commit
+	}
+	return r.Ref
+}
+
 func (r *Repository) IsGithub() bool {
 	return githubparserv1.IsHostGitHub(r.Domain)
 }
@@ -258,3 +258,48 @@ func TestRepositoryString(t *testing.T) {
 		}
 	}
 }
+
+func TestRepositoryRevision(t *testing.T) {
+	testCases := []struct {
+		repo     *Repository
+		revision string
+		isPinned bool
+	}{
+		{
+			repo: &Repository{
+				Ref: "main",
+			},
+			revision: "main",
+			isPinned: false,
+		},
+		{
+			repo: &Repository{
+				Ref:    "main",
+				Commit: "2fd4e1c67a2d28fced849ee1bb76e7391b93eb12",
+			},
+			revision: "2fd4e1c67a2d28fced849ee1bb76e7391b93eb12",
+			isPinned: true,
+		},
+		{
+			repo: &Repository{
+				Ref:    "main",
+				Commit: "2fd4e1c67a2d28fced849ee1bb76e7391b93eb12",
+				Follow: true,
+			},
+			revision: "main",
+			isPinned: false,
+		},
+	}
+
+	for i, tc := range testCases {
+		revision := tc.repo.Revision()
+		isPinned := tc.repo.IsPinned()
+
+		if revision != tc.revision {
+			t.Fatalf("Unexpect repo revision %q, expect %q, index %d", revision, tc.revision, i)
+		}
+		if isPinned != tc.isPinned {
+			t.Fatalf("Unexpect repo isPinned %v, expect %v, index %d", isPinned, tc.isPinned, i)
+		}
+	}
+}